@@ -0,0 +1,152 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+
+	"go.arsenm.dev/lrpc/errs"
+	"go.arsenm.dev/lrpc/internal/types"
+)
+
+// ErrUnexpectedAuth is returned when the server sends an unexpected
+// message while the client is being authenticated
+var ErrUnexpectedAuth = errors.New("unexpected message during authentication")
+
+// Credentials authenticate the client when it connects to the server
+type Credentials interface {
+	// Authenticate exchanges messages with the
+	// server's authenticator using ex
+	Authenticate(ex *AuthExchange) error
+}
+
+// CredentialsFunc is a function that implements Credentials
+type CredentialsFunc func(ex *AuthExchange) error
+
+func (fn CredentialsFunc) Authenticate(ex *AuthExchange) error {
+	return fn(ex)
+}
+
+// AuthExchange is used by credentials to exchange
+// messages with the server's authenticator
+type AuthExchange struct {
+	conn *conn
+}
+
+// Send sends a message to the server
+func (ex *AuthExchange) Send(v any) error {
+	data, err := ex.conn.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return ex.conn.codec.Encode(types.Request{
+		Type: types.RequestTypeAuth,
+		Arg:  data,
+	})
+}
+
+// Recv receives a message from the server and decodes it into v,
+// which must be a pointer. If the server rejected the client,
+// it returns the server's error.
+func (ex *AuthExchange) Recv(v any) error {
+	var resp types.Response
+	err := ex.conn.codec.Decode(&resp)
+	if err != nil {
+		return err
+	}
+
+	switch resp.Type {
+	case types.ResponseTypeAuth:
+		return ex.conn.codec.Unmarshal(resp.Return, v)
+	case types.ResponseTypeError:
+		return ex.conn.decodeErr(resp.Error)
+	default:
+		return ErrUnexpectedAuth
+	}
+}
+
+// authenticate authenticates the client on cn using its credentials,
+// and waits for the server to accept it
+func (c *Client) authenticate(cn *conn) error {
+	if c.creds == nil {
+		return nil
+	}
+
+	err := c.creds.Authenticate(&AuthExchange{conn: cn})
+	if err != nil {
+		return err
+	}
+
+	var resp types.Response
+	err = cn.codec.Decode(&resp)
+	if err != nil {
+		return err
+	}
+
+	switch resp.Type {
+	case types.ResponseTypeAuthDone:
+		return nil
+	case types.ResponseTypeError:
+		return cn.decodeErr(resp.Error)
+	default:
+		return ErrUnexpectedAuth
+	}
+}
+
+// decodeErr reconstructs an error received from the server on cn
+func (cn *conn) decodeErr(e *types.Error) error {
+	if e == nil {
+		return errs.New(errs.CodeUnknown, "unknown error")
+	}
+	return errs.Decode(cn.codec, errs.Code(e.Code), e.Message, e.Details)
+}
+
+// TokenCredentials returns credentials that send the given token
+// to the server, for use with server.TokenAuthenticator
+func TokenCredentials(token string) Credentials {
+	return CredentialsFunc(func(ex *AuthExchange) error {
+		return ex.Send(token)
+	})
+}
+
+// HMACCredentials returns credentials that prove that the client knows
+// the given key, for use with server.HMACAuthenticator. The key itself
+// is never sent to the server.
+func HMACCredentials(id string, key []byte) Credentials {
+	return CredentialsFunc(func(ex *AuthExchange) error {
+		err := ex.Send(id)
+		if err != nil {
+			return err
+		}
+
+		var challenge []byte
+		err = ex.Recv(&challenge)
+		if err != nil {
+			return err
+		}
+
+		// Respond to the challenge using the key
+		h := hmac.New(sha256.New, key)
+		h.Write(challenge)
+		return ex.Send(h.Sum(nil))
+	})
+}
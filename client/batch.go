@@ -0,0 +1,167 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+
+	"go.arsenm.dev/lrpc/internal/types"
+
+	"github.com/gofrs/uuid"
+)
+
+// Batch error values
+var (
+	ErrBatchChannel = errors.New("channels cannot be sent in batches")
+	ErrInvalidBatch = errors.New("server sent an invalid batch response")
+	ErrBatchArg     = errors.New("batch argument must be a []*BatchCall")
+)
+
+// BatchCall is a call sent as part of a batch
+type BatchCall struct {
+	Receiver string
+	Method   string
+	Arg      any
+	// Ret is a pointer to the value the return value
+	// will be stored in, or nil if it's not needed
+	Ret any
+
+	// Err is the error returned by the call.
+	// It is set once the batch is done.
+	Err error
+	// Meta is the metadata sent back by the server
+	// for this call. It is set once the batch is done.
+	Meta Metadata
+}
+
+// Batch sends all the given calls to the server in a single request,
+// and waits for all of their results, which are sent back in a single
+// response. If concurrent is true, the server may execute the calls
+// concurrently. Otherwise, they are executed one after the other,
+// in order.
+//
+// The result of each call is stored in its Ret and Err fields. The
+// returned error is only non-nil if the batch as a whole failed.
+// Metadata from ctx is sent along with every call. Interceptors are
+// run once for the whole batch, and channels cannot be used in it.
+func (c *Client) Batch(ctx context.Context, calls []*BatchCall, concurrent bool) error {
+	inv := c.chain(func(ctx context.Context, _, _ string, arg, _ any) error {
+		calls, ok := arg.([]*BatchCall)
+		if !ok {
+			return ErrBatchArg
+		}
+		return c.batch(ctx, calls, concurrent)
+	})
+	return inv(ctx, "lrpc", "Batch", calls, nil)
+}
+
+// batch sends a batch to the server and waits for its response
+func (c *Client) batch(ctx context.Context, calls []*BatchCall, concurrent bool) error {
+	// Create new v4 UUID
+	id, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+	idStr := id.String()
+
+	// If the context has a deadline, get the remaining
+	// time so that the server can enforce it
+	timeout, err := callTimeout(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Create request
+	req := types.Request{
+		Type:       types.RequestTypeBatch,
+		ID:         idStr,
+		Timeout:    timeout,
+		Meta:       MetadataFromContext(ctx),
+		Batch:      make([]types.Request, len(calls)),
+		Concurrent: concurrent,
+	}
+
+	// Add every call to the batch
+	for i, call := range calls {
+		if reflect.ValueOf(call.Arg).Kind() == reflect.Chan {
+			return ErrBatchChannel
+		}
+
+		argData, err := c.getCodec().Marshal(call.Arg)
+		if err != nil {
+			return err
+		}
+
+		req.Batch[i] = types.Request{
+			ID:       strconv.Itoa(i),
+			Receiver: call.Receiver,
+			Method:   call.Method,
+			Arg:      argData,
+		}
+	}
+
+	// Create new channel using the generated ID
+	respCh := make(chan *types.Response, 1)
+	c.chMtx.Lock()
+	c.chs[idStr] = respCh
+	c.waiting[idStr] = struct{}{}
+	c.chMtx.Unlock()
+
+	// Encode request using codec
+	err = c.encode(req)
+	if err != nil {
+		c.removeChannel(idStr)
+		return err
+	}
+
+	// Wait for the server's response
+	resp, err := c.waitResponse(ctx, idStr, respCh)
+	if err != nil {
+		return err
+	}
+
+	// If response is an error, return error
+	if resp.Type == types.ResponseTypeError {
+		return c.decodeErr(resp.Error)
+	}
+
+	// There must be exactly one response per call
+	if resp.Type != types.ResponseTypeBatch || len(resp.Batch) != len(calls) {
+		return ErrInvalidBatch
+	}
+
+	// Store the result of every call
+	for i, res := range resp.Batch {
+		calls[i].Meta = res.Meta
+
+		if res.Type == types.ResponseTypeError {
+			calls[i].Err = c.decodeErr(res.Error)
+			continue
+		}
+
+		if calls[i].Ret != nil && res.Return != nil {
+			calls[i].Err = c.getCodec().Unmarshal(res.Return, calls[i].Ret)
+		}
+	}
+
+	return nil
+}
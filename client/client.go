@@ -24,8 +24,11 @@ import (
 	"io"
 	"reflect"
 	"sync"
+	"time"
 
 	"go.arsenm.dev/lrpc/codec"
+	"go.arsenm.dev/lrpc/internal/flow"
+	"go.arsenm.dev/lrpc/internal/keepalive"
 	"go.arsenm.dev/lrpc/internal/types"
 
 	"github.com/gofrs/uuid"
@@ -39,33 +42,176 @@ var (
 	ErrReturnNotChannel = errors.New("function call returns channel but return value is not a channel type")
 	ErrReturnNotPointer = errors.New("function call returns value but return value is not a pointer")
 	ErrMismatchedType   = errors.New("type of channel does not match type returned by server")
+	ErrArgNotReceivable = errors.New("argument is a send-only channel")
+	ErrNotStream        = errors.New("method did not create a stream")
+	ErrNotifyChannel    = errors.New("notifications cannot send channels")
+	ErrConnectionClosed = errors.New("connection to server closed")
+	ErrKeepaliveTimeout = errors.New("server did not respond to keepalive ping")
+	ErrFlowControl      = errors.New("server sent more values than the channel's window allows")
 )
 
 // Client is an lrpc client
 type Client struct {
-	conn  io.ReadWriteCloser
-	codec codec.Codec
+	cf codec.CodecFunc
+
+	connMtx sync.RWMutex
+	conn    *conn
+	// connErr is the error returned to calls
+	// that were in progress when the connection
+	// was lost. It's protected by chMtx.
+	connErr error
+
+	// dial is used to reconnect to the server. If it's
+	// nil, the client doesn't reconnect.
+	dial        Dialer
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	resubscribe bool
+	state       State
+	stateCh     chan struct{}
+	onState     StateHandler
+
+	// closeCtx is canceled once the client is closed
+	closeCtx    context.Context
+	closeCancel context.CancelFunc
+
+	// done is closed once the client is closed for good,
+	// and err is the reason it was closed
+	done chan struct{}
+	err  error
+
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+
+	creds Credentials
+
+	maxMessageSize int64
+
+	// codecs are the names of the codecs offered
+	// to the server during the handshake
+	codecs []string
+
+	codecMtx sync.Mutex
 
 	chMtx *sync.Mutex
 	chs   map[string]chan *types.Response
+	// waiting contains the IDs of the calls and
+	// batches that are waiting for their response
+	waiting map[string]struct{}
+	// windows stores the credits granted by the server for
+	// channels sent to it, by the ID of the call
+	windows map[string]*flow.Window
+	// window is the amount of values that can be
+	// buffered for each channel returned by the server
+	window int
+
+	interceptors []Interceptor
+	invoker      Invoker
+}
+
+// conn is a connection to the server
+type conn struct {
+	rwc   io.ReadWriteCloser
+	codec codec.Codec
+
+	// done is closed once the connection is lost
+	done chan struct{}
+
+	// activity records when the last response was received
+	activity *keepalive.Activity
+	// dead is closed if the server stopped responding
+	// to keepalive pings
+	dead chan struct{}
+
+	goingAway     chan struct{}
+	goingAwayOnce sync.Once
+
+	// codecName is the name of the codec chosen during the handshake
+	codecName string
+
+	// closeErr is the last error sent by the server that
+	// wasn't for any call, which is likely the reason the
+	// server closed the connection. It's only accessed
+	// by handleConn.
+	closeErr error
+}
+
+// newConn creates a new connection using rwc and cf
+func newConn(rwc io.ReadWriteCloser, cf codec.CodecFunc) *conn {
+	return &conn{
+		rwc:       rwc,
+		codec:     cf(rwc),
+		done:      make(chan struct{}),
+		activity:  keepalive.NewActivity(),
+		dead:      make(chan struct{}),
+		goingAway: make(chan struct{}),
+	}
+}
+
+// New creates and returns a new client. If the client has
+// credentials, it's authenticated before New returns. If
+// authentication fails, the client is closed, and Err
+// returns the error.
+func New(conn io.ReadWriteCloser, cf codec.CodecFunc, opts ...Option) *Client {
+	out := newClient(cf, opts)
+
+	var err error
+	out.conn, err = out.connect(conn)
+	if err != nil {
+		out.finish(out.conn, err)
+		return out
+	}
+
+	go out.run()
+
+	return out
 }
 
-// New creates and returns a new client
-func New(conn io.ReadWriteCloser, cf codec.CodecFunc) *Client {
+// newClient creates a new client without a connection
+func newClient(cf codec.CodecFunc, opts []Option) *Client {
 	out := &Client{
-		conn:  conn,
-		codec: cf(conn),
-		chs:   map[string]chan *types.Response{},
-		chMtx: &sync.Mutex{},
+		cf:         cf,
+		chs:        map[string]chan *types.Response{},
+		waiting:    map[string]struct{}{},
+		chMtx:      &sync.Mutex{},
+		windows:    map[string]*flow.Window{},
+		window:     flow.DefaultWindow,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+		stateCh:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	out.closeCtx, out.closeCancel = context.WithCancel(context.Background())
+
+	// Apply all provided options
+	for _, opt := range opts {
+		opt(out)
 	}
 
-	go out.handleConn()
+	out.invoker = out.chain(out.call)
 
 	return out
 }
 
+// current returns the current connection
+func (c *Client) current() *conn {
+	c.connMtx.RLock()
+	defer c.connMtx.RUnlock()
+	return c.conn
+}
+
+// getCodec returns the codec of the current connection
+func (c *Client) getCodec() codec.Codec {
+	return c.current().codec
+}
+
 // Call calls a method on the server
 func (c *Client) Call(ctx context.Context, rcvr, method string, arg interface{}, ret interface{}) error {
+	return c.invoker(ctx, rcvr, method, arg, ret)
+}
+
+// call sends a call to the server and waits for its response
+func (c *Client) call(ctx context.Context, rcvr, method string, arg interface{}, ret interface{}) error {
 	// Create new v4 UUOD
 	id, err := uuid.NewV4()
 	if err != nil {
@@ -75,42 +221,138 @@ func (c *Client) Call(ctx context.Context, rcvr, method string, arg interface{},
 
 	ctxDoneVal := reflect.ValueOf(ctx.Done())
 
-	// Create new channel using the generated ID
-	c.chMtx.Lock()
-	c.chs[idStr] = make(chan *types.Response, 1)
-	c.chMtx.Unlock()
-
-	argData, err := c.codec.Marshal(arg)
+	// If the context has a deadline, get the remaining
+	// time so that the server can enforce it
+	timeout, err := callTimeout(ctx)
 	if err != nil {
 		return err
 	}
 
-	// Encode request using codec
-	err = c.codec.Encode(types.Request{
+	// Create request
+	req := types.Request{
 		ID:       idStr,
 		Receiver: rcvr,
 		Method:   method,
-		Arg:      argData,
-	})
-	if err != nil {
-		return err
+		Timeout:  timeout,
+		Meta:     MetadataFromContext(ctx),
+		Window:   c.window,
 	}
 
-	// Get response from channel
-	c.chMtx.Lock()
-	respCh := c.chs[idStr]
-	c.chMtx.Unlock()
-	resp := <-respCh
+	// If ret is a stream, this call creates a stream
+	st, isStream := ret.(*Stream)
+	if isStream {
+		req.Type = types.RequestTypeStream
+	}
 
-	// Close and delete channel
+	// Get reflect value of argument
+	argVal := reflect.ValueOf(arg)
+
+	// If this is a notification, send the request without
+	// waiting for a response
+	if IsNotification(ctx) {
+		if argVal.Kind() == reflect.Chan {
+			return ErrNotifyChannel
+		}
+
+		req.Arg, err = c.getCodec().Marshal(arg)
+		if err != nil {
+			return err
+		}
+		req.Notify = true
+
+		return c.encode(req)
+	}
+
+	// If the argument is a channel, its values will be sent
+	// to the server separately. Otherwise, encode it.
+	if argVal.Kind() == reflect.Chan && !isStream {
+		if argVal.Type().ChanDir()&reflect.RecvDir == 0 {
+			return ErrArgNotReceivable
+		}
+		req.Type = types.RequestTypeChannel
+	} else {
+		req.Arg, err = c.getCodec().Marshal(arg)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Create new channel using the generated ID
+	respCh := make(chan *types.Response, 1)
 	c.chMtx.Lock()
-	close(c.chs[idStr])
-	delete(c.chs, idStr)
+	c.chs[idStr] = respCh
+	c.waiting[idStr] = struct{}{}
+	// If values will be sent to the server, create a window
+	// for the credits it will grant
+	if req.Type == types.RequestTypeChannel || req.Type == types.RequestTypeStream {
+		c.windows[idStr] = flow.NewWindow(0)
+	}
 	c.chMtx.Unlock()
 
+	// Encode request using codec
+	err = c.encode(req)
+	if err != nil {
+		c.removeChannel(idStr)
+		c.deleteWindow(idStr)
+		return err
+	}
+
+	// stopArg is closed once the server no longer
+	// needs the values of an argument channel
+	stopArg := make(chan struct{})
+	keepArg := false
+	defer func() {
+		if !keepArg {
+			close(stopArg)
+		}
+	}()
+
+	// If the argument is a channel, start sending its values
+	if req.Type == types.RequestTypeChannel {
+		go c.sendChannel(ctx, idStr, argVal, stopArg)
+	}
+
+	// Wait for the server's response
+	resp, err := c.waitResponse(ctx, idStr, respCh)
+	if err != nil {
+		return err
+	}
+
+	// Store any metadata sent back by the server
+	setResponseMetadata(ctx, resp.Meta)
+
 	// If response is an error, return error
 	if resp.Type == types.ResponseTypeError {
-		return errors.New(resp.Error)
+		c.deleteWindow(idStr)
+		return c.decodeErr(resp.Error)
+	}
+
+	// If this call should have created a stream
+	if isStream {
+		if resp.Type != types.ResponseTypeChannel {
+			c.deleteWindow(idStr)
+			return ErrNotStream
+		}
+
+		// Get channel ID returned in response
+		var chID string
+		err = c.getCodec().Unmarshal(resp.Return, &chID)
+		if err != nil {
+			return err
+		}
+
+		// Get the channel created for the channel ID, and the window
+		// for the stream. If they don't exist, the connection was lost.
+		c.chMtx.Lock()
+		ch, ok := c.chs[chID]
+		window := c.windows[idStr]
+		c.chMtx.Unlock()
+		if !ok {
+			return c.connError()
+		}
+
+		st.init(ctx, c, idStr, chID, ch, window)
+		return nil
 	}
 
 	// If there is no return value, stop now
@@ -123,44 +365,57 @@ func (c *Client) Call(ctx context.Context, rcvr, method string, arg interface{},
 
 	// If response is a channel
 	if resp.Type == types.ResponseTypeChannel {
-		// If return value is not a channel, return error
-		if retVal.Kind() != reflect.Chan {
-			return ErrReturnNotChannel
-		}
 		// Get channel ID returned in response
 		var chID string
-		err = c.codec.Unmarshal(resp.Return, &chID)
-		if resp.Return == nil {
-			return nil
+		err = c.getCodec().Unmarshal(resp.Return, &chID)
+		if err != nil {
+			return err
 		}
 
-		// Create new channel using channel ID
-		c.chMtx.Lock()
-		if _, ok := c.chs[chID]; !ok {
-			c.chs[chID] = make(chan *types.Response, 5)
+		// If return value is not a channel, close the server's
+		// channel and return error
+		if retVal.Kind() != reflect.Chan {
+			c.closeChannel(chID)
+			return ErrReturnNotChannel
 		}
+
+		// Get the channel created for the channel ID. If it
+		// doesn't exist, the connection was lost.
+		c.chMtx.Lock()
+		ch, ok := c.chs[chID]
 		c.chMtx.Unlock()
+		if !ok {
+			return c.connError()
+		}
+
+		// Keep sending values from the argument channel
+		// until the returned channel is done
+		keepArg = true
+
+		// Create granter that allows the server to send more
+		// values as they are received
+		granter := c.newGranter(chID)
 
 		go func() {
+			defer close(stopArg)
+
 			// Get type of channel elements
 			chElemType := retVal.Type().Elem()
 			// For every value received from channel
-			for val := range c.chs[chID] {
+			for val := range ch {
 				if val.Type == types.ResponseTypeChannelDone {
 					// Close and delete channel
-					c.chMtx.Lock()
-					close(c.chs[chID])
-					delete(c.chs, chID)
-					c.chMtx.Unlock()
+					c.removeChannel(chID)
 
 					// Close return channel
 					retVal.Close()
-					break
+					return
 				}
 
 				outVal := reflect.New(chElemType)
-				err = c.codec.Unmarshal(val.Return, outVal.Interface())
+				err := c.getCodec().Unmarshal(val.Return, outVal.Interface())
 				if err != nil {
+					granter.Consumed()
 					continue
 				}
 				outVal = outVal.Elem()
@@ -170,19 +425,24 @@ func (c *Client) Call(ctx context.Context, rcvr, method string, arg interface{},
 					{Dir: reflect.SelectRecv, Chan: ctxDoneVal, Send: reflect.Value{}},
 				})
 				if chosen == 1 {
-					c.Call(context.Background(), "lrpc", "ChannelDone", chID, nil)
-					// Close and delete channel
-					c.chMtx.Lock()
-					close(c.chs[chID])
-					delete(c.chs, chID)
-					c.chMtx.Unlock()
-
+					c.closeChannel(chID)
 					retVal.Close()
+					return
 				}
+				granter.Consumed()
+			}
+
+			// The channel was closed because the connection was lost.
+			// If possible, call the method again once the client has
+			// reconnected, sending its values to the same channel.
+			if c.resubscribe && req.Type == types.RequestTypeNormal {
+				c.resubscribeChannel(ctx, rcvr, method, arg, retVal)
+			} else {
+				retVal.Close()
 			}
 		}()
 	} else if resp.Type == types.ResponseTypeNormal {
-		err = c.codec.Unmarshal(resp.Return, ret)
+		err = c.getCodec().Unmarshal(resp.Return, ret)
 		if err != nil {
 			return err
 		}
@@ -191,31 +451,334 @@ func (c *Client) Call(ctx context.Context, rcvr, method string, arg interface{},
 	return nil
 }
 
-func (c *Client) handleConn() {
+// callTimeout returns the time remaining until the deadline of ctx,
+// or zero if it has no deadline. If the deadline has already passed,
+// it returns context.DeadlineExceeded.
+func callTimeout(ctx context.Context) (time.Duration, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+
+	return timeout, nil
+}
+
+// waitResponse waits for the response to the call with the given ID
+// on respCh. If ctx is done first, it tells the server to cancel the call.
+// respCh is passed in rather than taken from the channel map, since the
+// call may have already failed and been removed from the map.
+func (c *Client) waitResponse(ctx context.Context, id string, respCh chan *types.Response) (*types.Response, error) {
+	var resp *types.Response
+	select {
+	case r, ok := <-respCh:
+		// If the channel was closed, the connection was lost
+		if !ok {
+			return nil, c.connError()
+		}
+		resp = r
+	case <-ctx.Done():
+		// Delete the channel so that any late response is discarded
+		c.chMtx.Lock()
+		delete(c.chs, id)
+		delete(c.waiting, id)
+		delete(c.windows, id)
+		c.chMtx.Unlock()
+
+		// Tell the server to cancel the call
+		go c.call(context.Background(), "lrpc", "CancelCall", id, nil)
+
+		return nil, ctx.Err()
+	}
+
+	// Close and delete channel
+	c.removeChannel(id)
+
+	return resp, nil
+}
+
+// sendChannel sends every value received from ch to the server as
+// part of the call with the given ID, until ch is closed, stop is
+// closed, or ctx is done.
+func (c *Client) sendChannel(ctx context.Context, id string, ch reflect.Value, stop chan struct{}) {
+	c.chMtx.Lock()
+	window := c.windows[id]
+	c.chMtx.Unlock()
+	defer c.deleteWindow(id)
+
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: ch},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(stop)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	}
+
 	for {
-		resp := &types.Response{}
-		// Attempt to decode response using codec
-		err := c.codec.Decode(resp)
+		chosen, val, ok := reflect.Select(cases)
+		if chosen != 0 {
+			return
+		}
+
+		// If the channel was closed, tell the server
+		if !ok {
+			c.encode(types.Request{
+				Type: types.RequestTypeChannelDone,
+				ID:   id,
+			})
+			return
+		}
+
+		data, err := c.getCodec().Marshal(val.Interface())
 		if err != nil {
 			continue
 		}
 
+		// Wait until the server is ready for another value
+		if !window.Take(stop, ctx.Done()) {
+			return
+		}
+
+		// Send value to server
+		err = c.encode(types.Request{
+			Type: types.RequestTypeChannelValue,
+			ID:   id,
+			Arg:  data,
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// newGranter creates a granter that grants credits to the server
+// as values are consumed from the channel with the given ID
+func (c *Client) newGranter(chID string) *flow.Granter {
+	return flow.NewGranter(c.window, func(n int) {
+		c.encode(types.Request{
+			Type:   types.RequestTypeCredit,
+			ID:     chID,
+			Window: n,
+		})
+	})
+}
+
+// deleteWindow deletes the window of the call with the given ID
+func (c *Client) deleteWindow(id string) {
+	c.chMtx.Lock()
+	delete(c.windows, id)
+	c.chMtx.Unlock()
+}
+
+// closeChannel tells the server to close the channel with the
+// given ID and removes it from the channel map
+func (c *Client) closeChannel(chID string) {
+	c.call(context.Background(), "lrpc", "ChannelDone", chID, nil)
+
+	// Close and delete channel
+	c.removeChannel(chID)
+}
+
+// removeChannel closes the channel with the given ID
+// and removes it from the channel map, if it exists
+func (c *Client) removeChannel(id string) {
+	c.chMtx.Lock()
+	defer c.chMtx.Unlock()
+
+	delete(c.waiting, id)
+	if ch, ok := c.chs[id]; ok {
+		close(ch)
+		delete(c.chs, id)
+	}
+}
+
+// decodeErr reconstructs an error received from the server
+func (c *Client) decodeErr(e *types.Error) error {
+	return c.current().decodeErr(e)
+}
+
+// encode encodes a request using the client's codec
+func (c *Client) encode(req types.Request) error {
+	c.codecMtx.Lock()
+	defer c.codecMtx.Unlock()
+
+	// If the connection was lost, don't try to use it
+	cn := c.current()
+	select {
+	case <-cn.done:
+		return c.connError()
+	default:
+	}
+
+	return cn.codec.Encode(req)
+}
+
+// handleConn handles responses sent by the server on cn
+// until the connection is lost, and returns the error that
+// caused the connection to be lost
+func (c *Client) handleConn(cn *conn) error {
+	for {
+		resp := &types.Response{}
+		// Attempt to decode response using codec. Most codecs read
+		// directly from the connection, so they can't recover
+		// from errors, and the connection can't be used anymore.
+		// Framed codecs can skip responses they can't decode.
+		err := cn.codec.Decode(resp)
+		if errors.Is(err, codec.ErrMalformed) {
+			// The codec skipped the response,
+			// so the connection can still be used
+			continue
+		} else if err != nil {
+			// If the server sent an error before closing
+			// the connection, return it instead
+			if cn.closeErr != nil && errors.Is(err, io.EOF) {
+				return cn.closeErr
+			}
+			return err
+		}
+
+		cn.activity.Touch()
+
+		switch resp.Type {
+		case types.ResponseTypePing:
+			// The server wants to know if the client is still there.
+			// The pong is sent in a separate goroutine, so that
+			// responses keep being read even if sending blocks.
+			go c.encode(types.Request{Type: types.RequestTypePong})
+			continue
+		case types.ResponseTypePong:
+			// The server responded to a ping
+			continue
+		}
+
+		// Errors that aren't for any call are about the connection,
+		// such as a message that was too large. The server may close
+		// the connection after sending one, in which case it's the
+		// reason the connection was closed.
+		if resp.Type == types.ResponseTypeError && resp.ID == "" {
+			cn.closeErr = cn.decodeErr(resp.Error)
+			c.failWaiting(resp.Error)
+			continue
+		}
+
+		// If the server is shutting down, let the application know
+		if resp.Type == types.ResponseTypeGoingAway {
+			cn.goingAwayOnce.Do(func() { close(cn.goingAway) })
+			continue
+		}
+
 		c.chMtx.Lock()
+
+		// If the server granted credits, add them to the
+		// window of the channel they're for
+		if resp.Type == types.ResponseTypeCredit {
+			if window, ok := c.windows[resp.ID]; ok {
+				window.Add(resp.Window)
+			}
+			c.chMtx.Unlock()
+			continue
+		}
+
 		// Attempt to get channel from map
 		ch, ok := c.chs[resp.ID]
-		// If channel does not exist, make it
-		if !ok {
-			ch = make(chan *types.Response, 5)
-			c.chs[resp.ID] = ch
+
+		// If this response creates a channel, create the
+		// channel that will receive its values now, so that
+		// no values are lost before the caller handles it
+		if resp.Type == types.ResponseTypeChannel {
+			var chID string
+			err = cn.codec.Unmarshal(resp.Return, &chID)
+			if err == nil {
+				if ok {
+					// The server sends at most as many values as the
+					// window allows, followed by ChannelDone
+					c.chs[chID] = make(chan *types.Response, c.window+1)
+				} else {
+					// The call was canceled, so nobody will read
+					// from this channel. Tell the server to close it.
+					go c.call(context.Background(), "lrpc", "ChannelDone", chID, nil)
+				}
+			}
+		}
+
+		// If there is no channel for this response, the call was
+		// canceled or already failed, or the channel was closed,
+		// so discard it. Otherwise, send the response to the channel.
+		// Flow control ensures there is always room, so if there isn't,
+		// the server sent more than it was allowed to, and responses
+		// would be lost, so the connection can't be used anymore.
+		if ok {
+			select {
+			case ch <- resp:
+			default:
+				c.chMtx.Unlock()
+				return ErrFlowControl
+			}
 		}
+
 		c.chMtx.Unlock()
+	}
+}
 
-		// Send response to channel
-		ch <- resp
+// failWaiting fails every call that's waiting for its response
+// with the given error. This is used when the server couldn't
+// decode a request well enough to know which call it belonged to,
+// so that call doesn't wait for a response that will never come.
+//
+// The failed calls are removed from the channel map, so if the
+// server still sends a response to one of them, it's discarded.
+func (c *Client) failWaiting(e *types.Error) {
+	c.chMtx.Lock()
+	defer c.chMtx.Unlock()
+
+	for id := range c.waiting {
+		if ch, ok := c.chs[id]; ok {
+			select {
+			case ch <- &types.Response{Type: types.ResponseTypeError, ID: id, Error: e}:
+			default:
+			}
+			delete(c.chs, id)
+		}
+		delete(c.waiting, id)
 	}
 }
 
-// Close closes the client
+// GoingAway returns a channel that is closed once the server
+// announces that it is shutting down. Calls that are already in
+// progress will still complete, but new calls will be rejected,
+// so the application should stop using the client and connect
+// to another server.
+//
+// If the client reconnects, the returned channel only applies
+// to the connection that was current when it was called.
+func (c *Client) GoingAway() <-chan struct{} {
+	return c.current().goingAway
+}
+
+// Done returns a channel that's closed once the client is closed,
+// either because Close was called, or because the connection was
+// lost and the client can't reconnect. Once it's closed, all calls
+// in progress have failed, and all channels returned by the server
+// have been closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns nil if Done is not yet closed. Otherwise, it returns
+// the reason the client was closed, which is or wraps
+// ErrConnectionClosed.
+func (c *Client) Err() error {
+	c.connMtx.RLock()
+	defer c.connMtx.RUnlock()
+	return c.err
+}
+
+// Close closes the client. All calls in progress fail with
+// ErrConnectionClosed, and all channels returned by the
+// server are closed.
 func (c *Client) Close() error {
-	return c.conn.Close()
+	c.closeCancel()
+	return c.current().rwc.Close()
 }
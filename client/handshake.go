@@ -0,0 +1,109 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"go.arsenm.dev/lrpc/codec"
+	"go.arsenm.dev/lrpc/internal/handshake"
+)
+
+// ErrHandshakeFailed is returned when the client and
+// the server can't agree on a protocol version or codec
+var ErrHandshakeFailed = errors.New("handshake failed")
+
+// Codec returns the name of the codec chosen during the handshake,
+// or an empty string if the client doesn't perform the handshake
+func (c *Client) Codec() string {
+	return c.current().codecName
+}
+
+// connect sets up a new connection using rwc. It performs the
+// handshake if the client has a list of codecs, and authenticates
+// the client if it has credentials. The connection is returned
+// even if this fails, so that it can be closed.
+func (c *Client) connect(rwc io.ReadWriteCloser) (*conn, error) {
+	cf, name, hsErr := c.handshake(rwc)
+
+	// Enforce the message size limit, if there is one
+	if c.maxMessageSize > 0 {
+		cf = codec.Limit(cf, c.maxMessageSize)
+	}
+
+	cn := newConn(rwc, cf)
+	cn.codecName = name
+	if hsErr != nil {
+		return cn, hsErr
+	}
+
+	return cn, c.authenticate(cn)
+}
+
+// handshake agrees on a codec with the server and returns it,
+// along with its name. If the client doesn't have a list of
+// codecs, it returns the client's codec without doing anything.
+func (c *Client) handshake(rw io.ReadWriter) (codec.CodecFunc, string, error) {
+	if c.codecs == nil {
+		return c.cf, "", nil
+	}
+
+	_, err := io.WriteString(rw, handshake.Magic)
+	if err != nil {
+		return c.cf, "", err
+	}
+
+	err = handshake.Write(rw, handshake.Hello{
+		Versions: []int{handshake.Version},
+		Codecs:   c.codecs,
+	})
+	if err != nil {
+		return c.cf, "", err
+	}
+
+	var reply handshake.Reply
+	err = handshake.Read(rw, &reply)
+	if err != nil {
+		return c.cf, "", err
+	}
+
+	if reply.Error != "" {
+		return c.cf, "", fmt.Errorf("%w: %s", ErrHandshakeFailed, reply.Error)
+	}
+
+	// Make sure the server chose one of the client's codecs
+	cf, ok := codec.Get(reply.Codec)
+	if !ok || !contains(c.codecs, reply.Codec) {
+		return c.cf, "", fmt.Errorf("%w: server chose unsupported codec %q", ErrHandshakeFailed, reply.Codec)
+	}
+
+	return cf, reply.Codec, nil
+}
+
+// contains returns true if names contains name
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package client
+
+import "context"
+
+// Invoker sends a call to the server and stores the
+// result in ret
+type Invoker func(ctx context.Context, rcvr, method string, arg, ret any) error
+
+// Interceptor wraps every call made by the client. It receives the
+// names of the receiver and method being called, the argument, the
+// value the result will be stored in, and the next invoker in the
+// chain. An interceptor may return early without calling next,
+// modify the values passed to next, or call next multiple times,
+// such as when retrying a call.
+//
+// For channel calls, ret is the channel that will receive values
+// from the server, and next returns once the channel has been
+// set up.
+//
+// Batches are intercepted once as a whole. The receiver and method
+// are "lrpc" and "Batch", arg is the []*BatchCall containing the
+// calls, and ret is nil.
+type Interceptor func(ctx context.Context, rcvr, method string, arg, ret any, next Invoker) error
+
+// chain wraps inv in the client's interceptors in reverse order,
+// so that the first interceptor is the outermost one
+func (c *Client) chain(inv Invoker) Invoker {
+	for i := len(c.interceptors) - 1; i >= 0; i-- {
+		inv = intercept(c.interceptors[i], inv)
+	}
+	return inv
+}
+
+// intercept returns an invoker that runs the given interceptor
+// with next as the next invoker in the chain
+func intercept(i Interceptor, next Invoker) Invoker {
+	return func(ctx context.Context, rcvr, method string, arg, ret any) error {
+		return i(ctx, rcvr, method, arg, ret, next)
+	}
+}
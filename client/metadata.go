@@ -0,0 +1,86 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// Metadata contains metadata sent along with a call,
+// such as authentication tokens or request IDs
+type Metadata map[string]string
+
+type metadataKey struct{}
+
+type responseMetadataKey struct{}
+
+// responseMetadata is stored in contexts returned by
+// WithResponseMetadata. mtx makes sure only one call
+// writes to md at a time.
+type responseMetadata struct {
+	mtx sync.Mutex
+	md  Metadata
+}
+
+// WithMetadata returns a copy of ctx containing the given metadata,
+// which will be sent to the server with every call made using the
+// returned context. If ctx already contains metadata, the two are
+// merged, with values in md taking precedence.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	out := Metadata{}
+	for k, v := range MetadataFromContext(ctx) {
+		out[k] = v
+	}
+	for k, v := range md {
+		out[k] = v
+	}
+	return context.WithValue(ctx, metadataKey{}, out)
+}
+
+// MetadataFromContext returns the metadata that will be sent
+// with calls made using ctx
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return md
+}
+
+// WithResponseMetadata returns a copy of ctx that causes calls made
+// using it to store the metadata sent back by the server in md.
+// md must not be nil. The returned context can be used for several
+// calls at once, but md should only be read once they've returned.
+func WithResponseMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, responseMetadataKey{}, &responseMetadata{md: md})
+}
+
+// setResponseMetadata stores the given metadata in the
+// response metadata of ctx, if it has any
+func setResponseMetadata(ctx context.Context, meta map[string]string) {
+	rm, ok := ctx.Value(responseMetadataKey{}).(*responseMetadata)
+	if !ok {
+		return
+	}
+
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+
+	for k, v := range meta {
+		rm.md[k] = v
+	}
+}
@@ -0,0 +1,44 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package client
+
+import "context"
+
+// notifyKey is the context key used to mark notifications
+type notifyKey struct{}
+
+// Notify calls a method on the server without waiting for a
+// response. The server does not send a response, so any return
+// value or error of the method is discarded. It returns once
+// the request has been sent.
+//
+// Interceptors are run for notifications as well, with a nil
+// return value. IsNotification can be used to tell them apart
+// from calls.
+func (c *Client) Notify(ctx context.Context, rcvr, method string, arg any) error {
+	ctx = context.WithValue(ctx, notifyKey{}, true)
+	return c.invoker(ctx, rcvr, method, arg, nil)
+}
+
+// IsNotification returns true if ctx belongs
+// to a notification sent using Notify
+func IsNotification(ctx context.Context) bool {
+	notify, _ := ctx.Value(notifyKey{}).(bool)
+	return notify
+}
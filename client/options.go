@@ -0,0 +1,122 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package client
+
+import "time"
+
+// Option configures a client
+type Option func(*Client)
+
+// WithInterceptors adds interceptors to the client. Interceptors
+// are run in the order they were provided, so the first one
+// is the outermost.
+func WithInterceptors(interceptors ...Interceptor) Option {
+	return func(c *Client) {
+		c.interceptors = append(c.interceptors, interceptors...)
+	}
+}
+
+// WithChannelWindow sets the window of channels returned by the
+// server, which is the amount of values that can be buffered by the
+// client for each channel. The server waits for the client to receive
+// values once the window is full, so that a slow consumer of one
+// channel doesn't block other calls. The window must be at least 1,
+// so smaller values are treated as 1.
+func WithChannelWindow(window int) Option {
+	return func(c *Client) {
+		if window < 1 {
+			window = 1
+		}
+		c.window = window
+	}
+}
+
+// WithBackoff sets the minimum and maximum amount of time a client
+// created using Dial waits between attempts to reconnect. The time
+// doubles after each failed attempt, starting at min, until it
+// reaches max.
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Client) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// WithResubscribe makes a client created using Dial call methods
+// that returned channels again once it reconnects, so that values
+// keep being sent to the same channels. Channels of calls whose
+// argument was a channel, and streams, can't be resubscribed,
+// so they're closed when the connection is lost.
+func WithResubscribe() Option {
+	return func(c *Client) {
+		c.resubscribe = true
+	}
+}
+
+// WithStateHandler sets a function that will be called whenever the
+// state of the client's connection changes. It's called from the
+// goroutine handling the connection, so it should not block.
+func WithStateHandler(h StateHandler) Option {
+	return func(c *Client) {
+		c.onState = h
+	}
+}
+
+// WithKeepalive makes the client ping the server every interval.
+// If the server doesn't send anything back within timeout of a
+// ping, the connection is considered lost.
+func WithKeepalive(interval, timeout time.Duration) Option {
+	return func(c *Client) {
+		c.keepaliveInterval = interval
+		c.keepaliveTimeout = timeout
+	}
+}
+
+// WithCredentials sets the credentials used to authenticate
+// the client whenever it connects to the server
+func WithCredentials(creds Credentials) Option {
+	return func(c *Client) {
+		c.creds = creds
+	}
+}
+
+// WithMaxMessageSize limits the size of messages sent by the server to
+// n bytes. Messages are checked while they're being read, so larger
+// ones are never read into memory. If the server sends a larger
+// message, the connection is closed with codec.ErrMessageTooLarge,
+// as the rest of the message can't be skipped. The limit is
+// approximate, as codecs may read ahead of the current message.
+// It doesn't apply to framed codecs, which enforce their own limit.
+func WithMaxMessageSize(n int64) Option {
+	return func(c *Client) {
+		c.maxMessageSize = n
+	}
+}
+
+// WithCodecs makes the client perform a handshake when it connects,
+// in which it offers the codecs with the given names, in order of
+// preference, and the server chooses one of them. The codecs must
+// be registered using codec.Register. Without this option, the
+// codec passed to New or Dial is used, and the server must use
+// the same one for clients that don't perform the handshake.
+func WithCodecs(names ...string) Option {
+	return func(c *Client) {
+		c.codecs = names
+	}
+}
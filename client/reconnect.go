@@ -0,0 +1,353 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"go.arsenm.dev/lrpc/codec"
+	"go.arsenm.dev/lrpc/internal/keepalive"
+	"go.arsenm.dev/lrpc/internal/types"
+)
+
+// ErrConnectionLost is returned by calls that were in progress
+// when the connection to the server was lost, and by calls
+// made while the client is reconnecting
+var ErrConnectionLost = errors.New("connection to server lost")
+
+const (
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+// Dialer creates a new connection to the server
+type Dialer func(ctx context.Context) (io.ReadWriteCloser, error)
+
+// State is the state of a client's connection to the server
+type State uint8
+
+const (
+	// StateConnected means the client is connected to the server
+	StateConnected State = iota
+	// StateReconnecting means the connection was lost,
+	// and the client is trying to reconnect
+	StateReconnecting
+	// StateClosed means the client was closed, or the connection
+	// was lost and the client can't reconnect
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// StateHandler is called whenever the state of
+// a client's connection changes
+type StateHandler func(State)
+
+// Dial creates a new client that connects to the server using dial.
+// If the connection is lost, all calls in progress fail with
+// ErrConnectionLost, and the client reconnects using dial, waiting
+// longer after each failed attempt.
+//
+// If the client has credentials, it's authenticated every time
+// it connects. If dial or authentication fails the first time,
+// Dial returns the error.
+func Dial(ctx context.Context, dial Dialer, cf codec.CodecFunc, opts ...Option) (*Client, error) {
+	rwc, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := newClient(cf, opts)
+	out.dial = dial
+	out.conn, err = out.connect(rwc)
+	if err != nil {
+		rwc.Close()
+		return nil, err
+	}
+
+	go out.run()
+
+	return out, nil
+}
+
+// State returns the current state of the client's connection
+func (c *Client) State() State {
+	c.connMtx.RLock()
+	defer c.connMtx.RUnlock()
+	return c.state
+}
+
+// run handles the client's connection, reconnecting
+// whenever it's lost if the client has a dialer
+func (c *Client) run() {
+	for {
+		cn := c.current()
+
+		// Detect dead connections
+		if c.keepaliveInterval > 0 {
+			go c.keepalive(cn)
+		}
+
+		err := c.handleConn(cn)
+
+		// If the server stopped responding, use a more
+		// useful error than the one from the closed connection
+		select {
+		case <-cn.dead:
+			err = ErrKeepaliveTimeout
+		default:
+		}
+
+		// If the client was closed or can't reconnect, stop
+		if c.dial == nil || c.closeCtx.Err() != nil {
+			c.finish(cn, err)
+			return
+		}
+
+		c.setState(StateReconnecting)
+		c.lost(cn, ErrConnectionLost)
+
+		newCn, ok := c.reconnect()
+		if !ok {
+			c.finish(cn, nil)
+			return
+		}
+
+		c.connMtx.Lock()
+		c.conn = newCn
+		c.connMtx.Unlock()
+
+		c.setState(StateConnected)
+	}
+}
+
+// finish closes the client for good once cn is lost. If the
+// client wasn't closed using Close, cause is the error that
+// caused the connection to be lost.
+func (c *Client) finish(cn *conn, cause error) {
+	err := ErrConnectionClosed
+	if cause != nil && c.closeCtx.Err() == nil {
+		err = &closedError{cause: cause}
+	}
+	c.closeCancel()
+
+	c.lost(cn, err)
+
+	c.connMtx.Lock()
+	c.err = err
+	c.connMtx.Unlock()
+
+	c.setState(StateClosed)
+	close(c.done)
+}
+
+// keepalive pings the server on cn regularly, and
+// closes cn if the server stops responding
+func (c *Client) keepalive(cn *conn) {
+	ping := func() {
+		c.encode(types.Request{Type: types.RequestTypePing})
+	}
+
+	if keepalive.Run(cn.activity, c.keepaliveInterval, c.keepaliveTimeout, ping, cn.done) {
+		close(cn.dead)
+		cn.rwc.Close()
+	}
+}
+
+// reconnect tries to reconnect to the server until it succeeds or
+// the client is closed, waiting longer after each failed attempt.
+// It returns false if the client was closed.
+func (c *Client) reconnect() (*conn, bool) {
+	backoff := c.minBackoff
+	for {
+		cn, err := c.redial()
+		if err == nil {
+			// If the client was closed while dialing,
+			// the new connection won't be used
+			if c.closeCtx.Err() != nil {
+				cn.rwc.Close()
+				return nil, false
+			}
+			return cn, true
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-c.closeCtx.Done():
+			return nil, false
+		}
+
+		// Double the backoff, up to the maximum
+		backoff *= 2
+		if backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+// redial creates a new connection using the client's
+// dialer, performs the handshake, and authenticates it
+func (c *Client) redial() (*conn, error) {
+	rwc, err := c.dial(c.closeCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	cn, err := c.connect(rwc)
+	if err != nil {
+		rwc.Close()
+		return nil, err
+	}
+
+	return cn, nil
+}
+
+// setState changes the state of the client's connection
+// and calls the state handler, if there is one
+func (c *Client) setState(s State) {
+	c.connMtx.Lock()
+	c.state = s
+	// Wake up anything waiting for the state to change
+	close(c.stateCh)
+	c.stateCh = make(chan struct{})
+	c.connMtx.Unlock()
+
+	if c.onState != nil {
+		c.onState(s)
+	}
+}
+
+// waitConnected waits until the client is connected. It returns
+// false if the client was closed or ctx is done first.
+func (c *Client) waitConnected(ctx context.Context) bool {
+	for {
+		c.connMtx.RLock()
+		state, stateCh := c.state, c.stateCh
+		c.connMtx.RUnlock()
+
+		switch state {
+		case StateConnected:
+			return true
+		case StateClosed:
+			return false
+		}
+
+		select {
+		case <-stateCh:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// lost marks cn as lost and fails every call in progress with err
+func (c *Client) lost(cn *conn, err error) {
+	cn.rwc.Close()
+
+	c.chMtx.Lock()
+	defer c.chMtx.Unlock()
+
+	c.connErr = err
+	// The connection may have already been marked as lost
+	// if the client was closed while reconnecting
+	select {
+	case <-cn.done:
+	default:
+		close(cn.done)
+	}
+
+	// Close every channel, so that calls waiting for
+	// a response or values return the error
+	for id, ch := range c.chs {
+		close(ch)
+		delete(c.chs, id)
+	}
+	for id := range c.waiting {
+		delete(c.waiting, id)
+	}
+
+	// The server has forgotten about any channels
+	// sent to it, so their credits are useless
+	for id := range c.windows {
+		delete(c.windows, id)
+	}
+}
+
+// closedError is returned once the client is closed because
+// of an error. It matches ErrConnectionClosed, and wraps the
+// error that caused it.
+type closedError struct {
+	cause error
+}
+
+func (ce *closedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrConnectionClosed, ce.cause)
+}
+
+func (ce *closedError) Is(target error) bool {
+	return target == ErrConnectionClosed
+}
+
+func (ce *closedError) Unwrap() error {
+	return ce.cause
+}
+
+// connError returns the error that caused
+// the connection to be lost
+func (c *Client) connError() error {
+	c.chMtx.Lock()
+	defer c.chMtx.Unlock()
+
+	if c.connErr == nil {
+		return ErrConnectionLost
+	}
+	return c.connErr
+}
+
+// resubscribeChannel calls a method that returned a channel again once
+// the client has reconnected, sending its values to the same channel.
+// If the client can't reconnect, ctx is done, or the call fails with
+// an error other than a lost connection, the channel is closed.
+func (c *Client) resubscribeChannel(ctx context.Context, rcvr, method string, arg any, retVal reflect.Value) {
+	for c.waitConnected(ctx) {
+		err := c.Call(ctx, rcvr, method, arg, retVal.Interface())
+		if err == nil {
+			return
+		} else if !errors.Is(err, ErrConnectionLost) {
+			break
+		}
+	}
+	retVal.Close()
+}
@@ -0,0 +1,220 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"go.arsenm.dev/lrpc/internal/flow"
+	"go.arsenm.dev/lrpc/internal/types"
+)
+
+// ErrStreamClosed is returned when sending on a stream
+// whose sending side has been closed
+var ErrStreamClosed = errors.New("stream is closed")
+
+// Stream is the client's side of a bidirectional stream
+// created using Client.Stream
+type Stream struct {
+	client *Client
+	conn   *conn
+	ctx    context.Context
+
+	// id is the ID of the call that created the stream,
+	// used to send values to the server
+	id string
+	// chID is the ID of the channel created by the server,
+	// used to receive values from the server
+	chID string
+	recv chan *types.Response
+
+	// window stores the credits granted by the server
+	window *flow.Window
+	// granter grants credits to the server
+	// as values are received
+	granter *flow.Granter
+
+	sendMtx    sync.Mutex
+	sendClosed bool
+
+	recvMtx    sync.Mutex
+	recvClosed bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Stream calls a method on the server that creates a stream using
+// server.Context.MakeStream, and returns the client's side of the
+// stream. Once ctx is done, the stream is closed. Close should be
+// called once the stream is no longer needed.
+func (c *Client) Stream(ctx context.Context, rcvr, method string, arg any) (*Stream, error) {
+	st := &Stream{}
+	err := c.invoker(ctx, rcvr, method, arg, st)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// init sets up the stream once the server has created it
+func (st *Stream) init(ctx context.Context, c *Client, id, chID string, recv chan *types.Response, window *flow.Window) {
+	st.client = c
+	st.conn = c.current()
+	st.ctx = ctx
+	st.id = id
+	st.chID = chID
+	st.recv = recv
+	st.window = window
+	st.done = make(chan struct{})
+
+	st.granter = c.newGranter(chID)
+
+	// Close the stream once the context is done
+	go func() {
+		select {
+		case <-ctx.Done():
+			st.Close()
+		case <-st.done:
+		}
+	}()
+}
+
+// Send sends a value to the server
+func (st *Stream) Send(v any) error {
+	st.sendMtx.Lock()
+	defer st.sendMtx.Unlock()
+
+	if st.sendClosed {
+		return ErrStreamClosed
+	}
+
+	data, err := st.client.getCodec().Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// Wait until the server is ready for another value
+	if !st.window.Take(st.done, st.conn.done) {
+		select {
+		case <-st.conn.done:
+			return st.client.connError()
+		default:
+			return ErrStreamClosed
+		}
+	}
+
+	return st.client.encode(types.Request{
+		Type: types.RequestTypeChannelValue,
+		ID:   st.id,
+		Arg:  data,
+	})
+}
+
+// Recv receives a value sent by the server and decodes it into v,
+// which must be a pointer. It returns io.EOF once the server has
+// closed its sending side of the stream.
+func (st *Stream) Recv(v any) error {
+	st.recvMtx.Lock()
+	defer st.recvMtx.Unlock()
+
+	if st.recvClosed {
+		return io.EOF
+	}
+
+	select {
+	case resp, ok := <-st.recv:
+		// If the channel was closed or the server is
+		// done sending, the receiving side is closed
+		if !ok || resp.Type == types.ResponseTypeChannelDone {
+			st.recvClosed = true
+
+			// If the channel was closed because the
+			// connection was lost, return the error
+			if !ok && st.isLost() {
+				return st.client.connError()
+			}
+
+			// Delete channel from map
+			st.client.chMtx.Lock()
+			delete(st.client.chs, st.chID)
+			st.client.chMtx.Unlock()
+
+			return io.EOF
+		}
+
+		// Allow the server to send another value
+		st.granter.Consumed()
+
+		return st.client.getCodec().Unmarshal(resp.Return, v)
+	case <-st.ctx.Done():
+		return st.ctx.Err()
+	}
+}
+
+// isLost returns true if the connection was lost
+// before the stream was closed
+func (st *Stream) isLost() bool {
+	select {
+	case <-st.done:
+		return false
+	case <-st.conn.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseSend closes the sending side of the stream. The server
+// will receive io.EOF once it has received all sent values.
+// The stream ends once both sides are closed.
+func (st *Stream) CloseSend() error {
+	st.sendMtx.Lock()
+	defer st.sendMtx.Unlock()
+
+	if st.sendClosed {
+		return nil
+	}
+	st.sendClosed = true
+	st.client.deleteWindow(st.id)
+
+	return st.client.encode(types.Request{
+		Type: types.RequestTypeChannelDone,
+		ID:   st.id,
+	})
+}
+
+// Close closes both sides of the stream immediately,
+// canceling the server's context
+func (st *Stream) Close() error {
+	st.closeOnce.Do(func() {
+		close(st.done)
+
+		st.sendMtx.Lock()
+		st.sendClosed = true
+		st.sendMtx.Unlock()
+		st.client.deleteWindow(st.id)
+
+		st.client.closeChannel(st.chID)
+	})
+	return nil
+}
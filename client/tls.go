@@ -0,0 +1,35 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+)
+
+// TLSDialer returns a dialer that connects to the given address using
+// TLS, for use with Dial. For mutual TLS, cfg should contain the
+// client's certificate. If cfg is nil, the default config is used.
+func TLSDialer(network, addr string, cfg *tls.Config) Dialer {
+	return func(ctx context.Context) (io.ReadWriteCloser, error) {
+		d := &tls.Dialer{Config: cfg}
+		return d.DialContext(ctx, network, addr)
+	}
+}
@@ -59,7 +59,8 @@ class LRPCClient
         fns.close()
         @callMap.delete(val.ID)
       when LRPCResponseType.Error
-        # Reject promise with error
+        # Reject promise with error, which is an object
+        # containing its Code, Message, and Details
         fns.reject(val.Error)
       end
 
@@ -23,7 +23,10 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"io"
+	"reflect"
+	"sync"
 
+	"github.com/fxamacker/cbor/v2"
 	"github.com/vmihailenco/msgpack/v5"
 )
 
@@ -46,6 +49,48 @@ type Codec interface {
 // Default is the default CodecFunc
 var Default = Msgpack
 
+var (
+	registryMtx sync.RWMutex
+	registry    = map[string]CodecFunc{}
+	names       []string
+)
+
+func init() {
+	Register("msgpack", Msgpack)
+	Register("json", JSON)
+	Register("gob", Gob)
+	Register("cbor", CBOR)
+}
+
+// Register registers a CodecFunc with the given name, so that
+// clients and servers can agree to use it during the handshake.
+// Both the server and the client should register the same codecs.
+func Register(name string, cf CodecFunc) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+
+	if _, ok := registry[name]; !ok {
+		names = append(names, name)
+	}
+	registry[name] = cf
+}
+
+// Get returns the CodecFunc registered with the given name
+func Get(name string) (CodecFunc, bool) {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	cf, ok := registry[name]
+	return cf, ok
+}
+
+// Names returns the names of all registered
+// codecs, in the order they were registered
+func Names() []string {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	return append([]string(nil), names...)
+}
+
 type JsonCodec struct {
 	*json.Encoder
 	*json.Decoder
@@ -113,3 +158,65 @@ func Gob(rw io.ReadWriter) Codec {
 		Decoder: gob.NewDecoder(rw),
 	}
 }
+
+var (
+	// cborDecMode decodes maps in empty interfaces as
+	// map[string]any, like the other codecs do
+	cborDecMode, _ = cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]any(nil)),
+	}.DecMode()
+
+	// cborEncMode encodes times as RFC 3339 strings,
+	// so that they keep their precision and time zone
+	cborEncMode, _ = cbor.EncOptions{
+		Time: cbor.TimeRFC3339Nano,
+	}.EncMode()
+
+	// cborDetEncMode uses core deterministic encoding
+	cborDetEncMode = func() cbor.EncMode {
+		opts := cbor.CoreDetEncOptions()
+		opts.Time = cbor.TimeRFC3339Nano
+		em, _ := opts.EncMode()
+		return em
+	}()
+)
+
+type CborCodec struct {
+	*cbor.Encoder
+	*cbor.Decoder
+	// Deterministic makes Marshal use core
+	// deterministic encoding, as described in
+	// RFC 8949, section 4.2.1
+	Deterministic bool
+}
+
+func (CborCodec) Unmarshal(data []byte, v any) error {
+	return cborDecMode.Unmarshal(data, v)
+}
+
+func (cc CborCodec) Marshal(v any) ([]byte, error) {
+	if cc.Deterministic {
+		return cborDetEncMode.Marshal(v)
+	}
+	return cborEncMode.Marshal(v)
+}
+
+// CBOR is a CodecFunc that creates a CBOR Codec
+func CBOR(rw io.ReadWriter) Codec {
+	return CborCodec{
+		Encoder: cborEncMode.NewEncoder(rw),
+		Decoder: cborDecMode.NewDecoder(rw),
+	}
+}
+
+// DeterministicCBOR is a CodecFunc that creates a CBOR Codec
+// which uses core deterministic encoding, as described in
+// RFC 8949, section 4.2.1, so that equal values are always
+// encoded to the same bytes
+func DeterministicCBOR(rw io.ReadWriter) Codec {
+	return CborCodec{
+		Encoder:       cborDetEncMode.NewEncoder(rw),
+		Decoder:       cborDecMode.NewDecoder(rw),
+		Deterministic: true,
+	}
+}
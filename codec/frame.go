@@ -0,0 +1,170 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrMalformed is returned by framed codecs when a frame can't be
+// decoded. The frame has been skipped, so the codec can still be
+// used to decode the next one.
+var ErrMalformed = errors.New("malformed frame")
+
+// DefaultMaxFrameSize is the maximum size of a
+// frame's payload used if none is provided
+const DefaultMaxFrameSize = 4 << 20
+
+// frameMessage is the type of frames that contain
+// a message. Frames of other types are skipped, so
+// that new types can be added later.
+const frameMessage byte = 1
+
+// frameHeaderSize is the size of a frame's header, which
+// contains its type and the length of its payload
+const frameHeaderSize = 5
+
+// Marshaler encodes and decodes single values. All codecs
+// implement it, but values that only implement Marshaler,
+// such as formats that aren't self-delimiting, can be used
+// with Framed as well.
+type Marshaler interface {
+	Unmarshal(data []byte, v any) error
+	Marshal(v any) ([]byte, error)
+}
+
+// Framed returns a CodecFunc that creates codecs which send every
+// message in a separate frame, with a header containing its type
+// and length, and use m to encode and decode the messages themselves.
+// For example, codec.Framed(codec.MsgpackCodec{}, 0) sends msgpack
+// messages in frames.
+//
+// Since the length of every frame is known before it's read, frames
+// that can't be decoded are skipped, and Decode returns an error
+// matching ErrMalformed, after which the next frame can be decoded.
+// Frames with payloads larger than max bytes are skipped without
+// being read into memory, and Decode returns an error matching both
+// ErrMalformed and ErrMessageTooLarge. If max is zero,
+// DefaultMaxFrameSize is used.
+//
+// Both ends of a connection must use framing. Framed codecs enforce
+// their own size limit, so they don't need to be wrapped using Limit.
+func Framed(m Marshaler, max int) CodecFunc {
+	if max <= 0 {
+		max = DefaultMaxFrameSize
+	}
+
+	return func(rw io.ReadWriter) Codec {
+		return &framedCodec{
+			Marshaler: m,
+			rw:        rw,
+			max:       max,
+		}
+	}
+}
+
+// framedCodec is a codec that sends messages in frames
+type framedCodec struct {
+	Marshaler
+	rw  io.ReadWriter
+	max int
+}
+
+func (fc *framedCodec) Encode(v any) error {
+	payload, err := fc.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// The other end would skip the frame anyway
+	if len(payload) > fc.max {
+		return ErrMessageTooLarge
+	}
+
+	// Write the header and payload at once, so that
+	// frames are never interleaved
+	frame := make([]byte, frameHeaderSize+len(payload))
+	frame[0] = frameMessage
+	binary.BigEndian.PutUint32(frame[1:frameHeaderSize], uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+
+	_, err = fc.rw.Write(frame)
+	return err
+}
+
+func (fc *framedCodec) Decode(v any) error {
+	for {
+		var header [frameHeaderSize]byte
+		_, err := io.ReadFull(fc.rw, header[:])
+		if err != nil {
+			return err
+		}
+
+		typ := header[0]
+		size := int64(binary.BigEndian.Uint32(header[1:]))
+
+		// Skip frames that are too large or of an unknown
+		// type, without reading them into memory
+		if size > int64(fc.max) || typ != frameMessage {
+			_, err = io.CopyN(io.Discard, fc.rw, size)
+			if err != nil {
+				return err
+			}
+
+			if typ != frameMessage {
+				continue
+			}
+			return &malformedError{ErrMessageTooLarge}
+		}
+
+		payload := make([]byte, size)
+		_, err = io.ReadFull(fc.rw, payload)
+		if err != nil {
+			return err
+		}
+
+		err = fc.Unmarshal(payload, v)
+		if err != nil {
+			return &malformedError{err}
+		}
+		return nil
+	}
+}
+
+// malformedError is returned when a frame was skipped.
+// It matches ErrMalformed as well as the error that
+// caused the frame to be skipped.
+type malformedError struct {
+	err error
+}
+
+func (me *malformedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrMalformed, me.err)
+}
+
+func (me *malformedError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+func (me *malformedError) Unwrap() error {
+	return me.err
+}
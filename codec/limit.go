@@ -0,0 +1,112 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package codec
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrMessageTooLarge is returned by codecs created using Limit
+// when a message is larger than the limit
+var ErrMessageTooLarge = errors.New("message too large")
+
+// Limit returns a CodecFunc that creates codecs using cf, which fail
+// with ErrMessageTooLarge when decoding a message larger than max
+// bytes, instead of reading the rest of it into memory.
+//
+// Codecs may read ahead of the message they're decoding, so the limit
+// is approximate. Once a codec returns ErrMessageTooLarge, the rest of
+// the message hasn't been read, so it can't decode any more messages.
+//
+// Framed codecs enforce their own limit and skip frames that are too
+// large, which the limit would prevent, so they're returned unwrapped.
+func Limit(cf CodecFunc, max int64) CodecFunc {
+	return func(rw io.ReadWriter) Codec {
+		lr := &limitReader{r: rw, max: max}
+		c := cf(readWriter{Reader: lr, Writer: rw})
+
+		// Make framed codecs read directly from the connection
+		if fc, ok := c.(*framedCodec); ok {
+			fc.rw = rw
+			return fc
+		}
+
+		return &limitCodec{
+			Codec: c,
+			lr:    lr,
+		}
+	}
+}
+
+// limitCodec is a codec that limits the size of decoded messages
+type limitCodec struct {
+	Codec
+	lr *limitReader
+}
+
+func (lc *limitCodec) Decode(v any) error {
+	// Every message can be up to the limit
+	lc.lr.reset()
+
+	err := lc.Codec.Decode(v)
+	// Codecs may wrap or replace errors returned by
+	// the reader, so check whether the limit was hit
+	if err != nil && lc.lr.exceeded {
+		return ErrMessageTooLarge
+	}
+	return err
+}
+
+// limitReader fails once more than max bytes
+// are read since it was last reset
+type limitReader struct {
+	r        io.Reader
+	max      int64
+	n        int64
+	exceeded bool
+}
+
+func (lr *limitReader) Read(b []byte) (int, error) {
+	if lr.exceeded || lr.n >= lr.max {
+		lr.exceeded = true
+		return 0, ErrMessageTooLarge
+	}
+
+	// Don't read past the limit
+	if rem := lr.max - lr.n; int64(len(b)) > rem {
+		b = b[:rem]
+	}
+
+	n, err := lr.r.Read(b)
+	lr.n += int64(n)
+	return n, err
+}
+
+// reset starts counting from zero again,
+// unless the limit was already exceeded
+func (lr *limitReader) reset() {
+	lr.n = 0
+}
+
+// readWriter combines a separate reader and writer
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
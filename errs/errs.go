@@ -0,0 +1,287 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package errs provides errors with codes that are preserved
+// when they are sent from an lrpc server to a client
+package errs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"go.arsenm.dev/lrpc/codec"
+)
+
+// <= go1.17 compatibility
+type any = interface{}
+
+// Code identifies the kind of an error
+type Code string
+
+// Built-in error codes
+const (
+	CodeUnknown           Code = "unknown"
+	CodeCanceled          Code = "canceled"
+	CodeDeadlineExceeded  Code = "deadline_exceeded"
+	CodeNoSuchReceiver    Code = "no_such_receiver"
+	CodeNoSuchMethod      Code = "no_such_method"
+	CodeInvalidMethod     Code = "invalid_method"
+	CodeNotStream         Code = "not_stream"
+	CodeNotifyChannel     Code = "notify_channel"
+	CodeBatchChannel      Code = "batch_channel"
+	CodeArgNotProvided    Code = "arg_not_provided"
+	CodeInvalidArgument   Code = "invalid_argument"
+	CodeArgNotChannel     Code = "arg_not_channel"
+	CodeUnexpectedChannel Code = "unexpected_channel"
+	CodePanic             Code = "panic"
+	CodeUnavailable       Code = "unavailable"
+	CodeUnauthenticated   Code = "unauthenticated"
+	CodePermissionDenied  Code = "permission_denied"
+	CodeResourceExhausted Code = "resource_exhausted"
+	CodeMessageTooLarge   Code = "message_too_large"
+	CodeFlowControl       Code = "flow_control"
+)
+
+// Error is an error with a code. When a method returns an Error,
+// the client receives an Error with the same code, message,
+// and details.
+type Error struct {
+	Code    Code
+	Message string
+	// Details contains additional information about the error.
+	// If the code was registered using RegisterType, it will be
+	// the value of the registered type. Otherwise, clients decode
+	// it into a generic value.
+	Details any
+
+	err error
+}
+
+// New creates a new error with the given code and message
+func New(code Code, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+// Errorf creates a new error with the given code and a message
+// formatted according to format. Like fmt.Errorf, it wraps the
+// error provided with the %w verb, if any.
+func Errorf(code Code, format string, v ...any) *Error {
+	err := fmt.Errorf(format, v...)
+	return &Error{Code: code, Message: err.Error(), err: errors.Unwrap(err)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the error wrapped by e. On the client, this is the
+// error registered for e's code, if any.
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Is returns true if target is an *Error with the same code as e.
+// Errors with CodeUnknown never match, so sentinel errors that need
+// to be told apart must each have their own code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return e.Code != CodeUnknown && t.Code == e.Code
+}
+
+// sentinel is a sentinel error registered with a code
+type sentinel struct {
+	code Code
+	err  error
+}
+
+// errType is an error type registered with a code
+type errType struct {
+	code Code
+	typ  reflect.Type
+}
+
+// The registered errors are kept in the order they were
+// registered, so that From always checks them in the same order
+var (
+	registryMtx sync.RWMutex
+	sentinels   []sentinel
+	errTypes    []errType
+)
+
+func init() {
+	Register(CodeCanceled, context.Canceled)
+	Register(CodeDeadlineExceeded, context.DeadlineExceeded)
+	Register(CodeMessageTooLarge, codec.ErrMessageTooLarge)
+}
+
+// Register registers a sentinel error value with the given code.
+// Errors matching err according to errors.Is are sent with the
+// code, and errors received with the code wrap err, so that
+// errors.Is works on the client.
+//
+// Both the server and the client should register the same errors.
+// Registering a code again replaces the error registered with it.
+func Register(code Code, err error) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+
+	for i := range sentinels {
+		if sentinels[i].code == code {
+			sentinels[i].err = err
+			return
+		}
+	}
+	sentinels = append(sentinels, sentinel{code, err})
+}
+
+// RegisterType registers the type of err with the given code.
+// Errors that can be assigned to a value of that type according
+// to errors.As are sent with the code and the value as details.
+// Errors received with the code wrap a new value of the type
+// decoded from the details, so that errors.As works on the client.
+//
+// Both the server and the client should register the same types.
+// Registering a code again replaces the type registered with it.
+func RegisterType(code Code, err error) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+
+	typ := reflect.TypeOf(err)
+	for i := range errTypes {
+		if errTypes[i].code == code {
+			errTypes[i].typ = typ
+			return
+		}
+	}
+	errTypes = append(errTypes, errType{code, typ})
+}
+
+// From converts err into an *Error. If err is or wraps an *Error,
+// or matches a registered error, its code is used. Otherwise,
+// the code is CodeUnknown. The message is always err.Error().
+//
+// Registered sentinel errors are checked before registered types,
+// and each of them is checked in the order they were registered,
+// so if err matches several of them, the first one is used.
+func From(err error) *Error {
+	if err == nil {
+		return nil
+	}
+
+	out := &Error{Code: CodeUnknown, Message: err.Error(), err: err}
+
+	// If err is or wraps an *Error, use its code and details
+	var e *Error
+	if errors.As(err, &e) {
+		out.Code = e.Code
+		out.Details = e.Details
+		return out
+	}
+
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+
+	// Check if err matches a registered sentinel error
+	for _, s := range sentinels {
+		if errors.Is(err, s.err) {
+			out.Code = s.code
+			return out
+		}
+	}
+
+	// Check if err matches a registered error type
+	for _, t := range errTypes {
+		target := reflect.New(t.typ)
+		if errors.As(err, target.Interface()) {
+			out.Code = t.code
+			out.Details = target.Elem().Interface()
+			return out
+		}
+	}
+
+	return out
+}
+
+// Decode creates an *Error from the code, message, and details
+// received from a server, using c to decode the details.
+// This is used by clients to reconstruct errors.
+func Decode(c codec.Codec, code Code, msg string, details []byte) *Error {
+	out := &Error{Code: code, Message: msg}
+
+	registryMtx.RLock()
+	sentinel, isSentinel := lookupSentinel(code)
+	typ, isType := lookupType(code)
+	registryMtx.RUnlock()
+
+	switch {
+	case isSentinel:
+		out.err = sentinel
+	case isType:
+		// Decode details into a new value of the registered type
+		val := reflect.New(typ)
+		if details != nil {
+			if err := c.Unmarshal(details, val.Interface()); err != nil {
+				return out
+			}
+		}
+		out.Details = val.Elem().Interface()
+		// If the registered type implements error, wrap the value
+		if err, ok := out.Details.(error); ok {
+			out.err = err
+		}
+	case details != nil:
+		// Decode details into a generic value,
+		// keeping the raw data if that fails
+		var val any
+		if err := c.Unmarshal(details, &val); err != nil {
+			out.Details = details
+		} else {
+			out.Details = val
+		}
+	}
+
+	return out
+}
+
+// lookupSentinel returns the sentinel error registered with code.
+// The registry must be locked.
+func lookupSentinel(code Code) (error, bool) {
+	for _, s := range sentinels {
+		if s.code == code {
+			return s.err, true
+		}
+	}
+	return nil, false
+}
+
+// lookupType returns the error type registered with code.
+// The registry must be locked.
+func lookupType(code Code) (reflect.Type, bool) {
+	for _, t := range errTypes {
+		if t.code == code {
+			return t.typ, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,127 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package flow implements credit-based flow control for channels
+package flow
+
+import (
+	"reflect"
+	"sync"
+)
+
+// DefaultWindow is the default amount of values that can
+// be in flight on a channel before the sender has to wait
+const DefaultWindow = 16
+
+// Window keeps track of the credits available to the sender of a
+// channel. Each credit allows the sender to send one value.
+type Window struct {
+	mtx     sync.Mutex
+	credits int
+	notify  chan struct{}
+}
+
+// NewWindow creates a window with the given amount of initial credits
+func NewWindow(credits int) *Window {
+	return &Window{
+		credits: credits,
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// Add adds n credits to the window
+func (w *Window) Add(n int) {
+	w.mtx.Lock()
+	w.credits += n
+	w.mtx.Unlock()
+
+	// Wake up a waiting sender, if any
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Take takes a credit from the window, waiting until one is available.
+// It returns false if any of the done channels are closed first.
+func (w *Window) Take(done ...<-chan struct{}) bool {
+	// Create select cases for the done channels
+	// and the notification channel
+	cases := make([]reflect.SelectCase, len(done)+1)
+	cases[0] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(w.notify)}
+	for i, ch := range done {
+		cases[i+1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)}
+	}
+
+	for {
+		w.mtx.Lock()
+		if w.credits > 0 {
+			w.credits--
+			w.mtx.Unlock()
+			// Pass the notification on in case there are more
+			// credits available for other waiting senders
+			w.Add(0)
+			return true
+		}
+		w.mtx.Unlock()
+
+		chosen, _, _ := reflect.Select(cases)
+		if chosen != 0 {
+			return false
+		}
+	}
+}
+
+// Granter keeps track of the values consumed by the receiver of a
+// channel and grants credits back to the sender in batches
+type Granter struct {
+	mtx       sync.Mutex
+	pending   int
+	threshold int
+	grant     func(n int)
+}
+
+// NewGranter creates a granter for a channel with the given window,
+// which calls grant to send credits back to the sender
+func NewGranter(window int, grant func(n int)) *Granter {
+	threshold := window / 2
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	return &Granter{
+		threshold: threshold,
+		grant:     grant,
+	}
+}
+
+// Consumed records that a value has been consumed, granting
+// credits to the sender once enough values have been consumed
+func (g *Granter) Consumed() {
+	g.mtx.Lock()
+	g.pending++
+	if g.pending < g.threshold {
+		g.mtx.Unlock()
+		return
+	}
+	n := g.pending
+	g.pending = 0
+	g.mtx.Unlock()
+
+	g.grant(n)
+}
@@ -0,0 +1,169 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package handshake implements the handshake in which a client
+// and a server agree on a protocol version and a codec
+package handshake
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// <= go1.17 compatibility
+type any = interface{}
+
+// Magic is sent by clients at the start of a connection to begin the
+// handshake. Messages encoded by codecs never start with a null byte,
+// so servers can tell clients that don't perform the handshake apart.
+const Magic = "\x00LRPC"
+
+// Version is the latest protocol version. Flow control and metadata
+// are part of every version, so changes to them require a new one.
+const Version = 1
+
+// maxSize is the maximum size of a handshake message
+const maxSize = 64 << 10
+
+var (
+	ErrBadMagic  = errors.New("handshake: invalid magic")
+	ErrTooLarge  = errors.New("handshake: message too large")
+	ErrNoVersion = errors.New("handshake: no supported protocol version")
+	ErrNoCodec   = errors.New("handshake: no supported codec")
+)
+
+// Hello is sent by the client after the magic
+type Hello struct {
+	// Versions are the protocol versions supported by the client
+	Versions []int `json:"versions"`
+	// Codecs are the names of the codecs supported by
+	// the client, in order of preference
+	Codecs []string `json:"codecs"`
+}
+
+// Reply is sent by the server in response to Hello
+type Reply struct {
+	// Version is the protocol version chosen by the server
+	Version int `json:"version,omitempty"`
+	// Codec is the name of the codec chosen by the server
+	Codec string `json:"codec,omitempty"`
+	// Error is set if the server rejected the handshake
+	Error string `json:"error,omitempty"`
+}
+
+// Detect reads from r to check whether the client is performing the
+// handshake. If it isn't, the returned reader returns the bytes that
+// were read, followed by the rest of r, so that they can be decoded
+// by a codec.
+func Detect(r io.Reader) (io.Reader, bool, error) {
+	first := make([]byte, 1)
+	_, err := io.ReadFull(r, first)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if first[0] != Magic[0] {
+		return io.MultiReader(bytes.NewReader(first), r), false, nil
+	}
+
+	rest := make([]byte, len(Magic)-1)
+	_, err = io.ReadFull(r, rest)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if string(rest) != Magic[1:] {
+		return nil, false, ErrBadMagic
+	}
+
+	return r, true, nil
+}
+
+// Write writes a handshake message, prefixed with its length
+func Write(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	msg := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(msg, uint32(len(data)))
+	copy(msg[4:], data)
+
+	_, err = w.Write(msg)
+	return err
+}
+
+// Read reads a handshake message written by Write into v.
+// It reads exactly as many bytes as the message contains.
+func Read(r io.Reader, v any) error {
+	var size [4]byte
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxSize {
+		return ErrTooLarge
+	}
+
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// Choose picks the reply to the given hello. The codec is the first
+// one in the client's list for which supported returns true.
+func Choose(h Hello, supported func(codec string) bool) (Reply, error) {
+	if !contains(h.Versions, Version) {
+		return Reply{}, ErrNoVersion
+	}
+
+	out := Reply{Version: Version}
+
+	for _, name := range h.Codecs {
+		if supported(name) {
+			out.Codec = name
+			break
+		}
+	}
+
+	if out.Codec == "" {
+		return Reply{}, ErrNoCodec
+	}
+
+	return out, nil
+}
+
+// contains returns true if versions contains v
+func contains(versions []int, v int) bool {
+	for _, version := range versions {
+		if version == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package keepalive detects dead connections by periodically
+// sending pings and checking that something was received back
+package keepalive
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Activity keeps track of the last time
+// a connection received a message
+type Activity struct {
+	last int64
+}
+
+// NewActivity creates a new Activity, as if
+// a message was just received
+func NewActivity() *Activity {
+	a := &Activity{}
+	a.Touch()
+	return a
+}
+
+// Touch records that a message was received
+func (a *Activity) Touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// Last returns the last time a message was received
+func (a *Activity) Last() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&a.last))
+}
+
+// Run sends a ping every interval using ping, and returns true if
+// nothing was received within timeout of sending it, meaning the
+// connection is dead. It returns false once done is closed.
+func Run(a *Activity, interval, timeout time.Duration, ping func(), done <-chan struct{}) bool {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return false
+		}
+
+		// Send the ping in a separate goroutine, as sending
+		// blocks if the other side isn't reading anymore
+		sent := time.Now()
+		go ping()
+
+		timer := time.NewTimer(timeout)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return false
+		}
+
+		// If nothing was received since the ping
+		// was sent, the connection is dead
+		if a.Last().Before(sent) {
+			return true
+		}
+	}
+}
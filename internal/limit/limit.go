@@ -0,0 +1,106 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package limit implements token buckets used to
+// limit how often calls can be made
+package limit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket. It holds up to burst tokens,
+// and is refilled at rate tokens per second.
+type Bucket struct {
+	mtx    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a new full bucket
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes n tokens from the bucket and returns true
+// if there are enough of them, otherwise it takes none
+// and returns false
+func (b *Bucket) Allow(n int) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	// Refill the bucket based on the time
+	// since it was last refilled
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Buckets holds a separate bucket for every key,
+// which is created when it's first used
+type Buckets struct {
+	mtx     sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*Bucket
+}
+
+// NewBuckets creates a new set of buckets with the given rate and burst
+func NewBuckets(rate float64, burst int) *Buckets {
+	return &Buckets{
+		rate:    rate,
+		burst:   burst,
+		buckets: map[string]*Bucket{},
+	}
+}
+
+// Bucket creates a bucket with the same rate and burst
+// as the buckets in the set, which isn't part of it
+func (bs *Buckets) Bucket() *Bucket {
+	return NewBucket(bs.rate, bs.burst)
+}
+
+// Allow takes n tokens from the bucket for the given key
+func (bs *Buckets) Allow(key string, n int) bool {
+	bs.mtx.Lock()
+	b, ok := bs.buckets[key]
+	if !ok {
+		b = NewBucket(bs.rate, bs.burst)
+		bs.buckets[key] = b
+	}
+	bs.mtx.Unlock()
+
+	return b.Allow(n)
+}
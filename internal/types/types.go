@@ -18,15 +18,69 @@
 
 package types
 
+import "time"
+
 // <= go1.17 compatibility
 type any = interface{}
 
+type RequestType uint8
+
+const (
+	RequestTypeNormal RequestType = iota
+	// RequestTypeChannel is a call whose argument is a channel
+	RequestTypeChannel
+	// RequestTypeChannelValue carries a value sent on
+	// the channel of a RequestTypeChannel call
+	RequestTypeChannelValue
+	// RequestTypeChannelDone is sent when the client closes
+	// the channel of a RequestTypeChannel call, or its side
+	// of a RequestTypeStream call
+	RequestTypeChannelDone
+	// RequestTypeStream is a call that creates a bidirectional
+	// stream. The client sends values on the stream using
+	// RequestTypeChannelValue with the ID of the call.
+	RequestTypeStream
+	// RequestTypeCredit grants credits for the channel with the
+	// given ID, allowing the server to send more values on it
+	RequestTypeCredit
+	// RequestTypeBatch contains multiple calls in Batch, whose
+	// results are sent back in a single ResponseTypeBatch
+	RequestTypeBatch
+	// RequestTypePing asks the server to reply with
+	// ResponseTypePong, to check that it's still there
+	RequestTypePing
+	// RequestTypePong replies to ResponseTypePing
+	RequestTypePong
+	// RequestTypeAuth carries a message sent by the client
+	// while it's being authenticated
+	RequestTypeAuth
+)
+
 // Request represents a request sent to the server
 type Request struct {
+	Type     RequestType
 	ID       string
 	Receiver string
 	Method   string
 	Arg      []byte
+	// Timeout is the amount of time the server has to
+	// complete the call. Zero means there is no timeout.
+	Timeout time.Duration
+	// Meta contains metadata sent along with the call
+	Meta map[string]string
+	// Window is the amount of values the client can buffer for
+	// a channel created by the call, or the amount of credits
+	// granted for RequestTypeCredit. Zero disables flow control.
+	Window int
+	// Notify is true if the client doesn't want a response.
+	// The server doesn't send anything back for such calls,
+	// not even errors.
+	Notify bool
+	// Batch contains the calls of a RequestTypeBatch
+	Batch []Request
+	// Concurrent is true if the calls in Batch
+	// may be executed concurrently
+	Concurrent bool
 }
 
 type ResponseType uint8
@@ -36,12 +90,48 @@ const (
 	ResponseTypeError
 	ResponseTypeChannel
 	ResponseTypeChannelDone
+	// ResponseTypeCredit grants credits for the channel sent by
+	// the client in the call with the given ID, allowing the
+	// client to send more values on it
+	ResponseTypeCredit
+	// ResponseTypeGoingAway tells the client that the server is
+	// shutting down and will not accept any new calls
+	ResponseTypeGoingAway
+	// ResponseTypeBatch contains the responses to the calls
+	// of a RequestTypeBatch, in the same order
+	ResponseTypeBatch
+	// ResponseTypePing asks the client to reply with
+	// RequestTypePong, to check that it's still there
+	ResponseTypePing
+	// ResponseTypePong replies to RequestTypePing
+	ResponseTypePong
+	// ResponseTypeAuth carries a message sent by the server
+	// while the client is being authenticated
+	ResponseTypeAuth
+	// ResponseTypeAuthDone tells the client that it was
+	// authenticated successfully. If authentication fails,
+	// ResponseTypeError is sent instead.
+	ResponseTypeAuthDone
 )
 
+// Error represents an error returned by the server
+type Error struct {
+	Code    string
+	Message string
+	Details []byte
+}
+
 // Response represents a response returned by the server
 type Response struct {
 	Type   ResponseType
 	ID     string
-	Error  string
+	Error  *Error
 	Return []byte
+	// Meta contains metadata sent back along with the response
+	Meta map[string]string
+	// Window is the amount of credits granted
+	// for ResponseTypeCredit
+	Window int
+	// Batch contains the responses of a ResponseTypeBatch
+	Batch []Response
 }
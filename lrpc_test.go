@@ -2,13 +2,28 @@ package lrpc_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"net"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"go.arsenm.dev/lrpc/client"
 	"go.arsenm.dev/lrpc/codec"
+	"go.arsenm.dev/lrpc/errs"
+	"go.arsenm.dev/lrpc/internal/types"
 	"go.arsenm.dev/lrpc/server"
 )
 
@@ -107,8 +122,9 @@ func TestCodecs(t *testing.T) {
 
 		s := server.New()
 		defer s.Close()
-		// Register Arith for RPC
+		// Register Arith and Counter for RPC
 		s.Register(Arith{})
+		s.Register(Counter{})
 		// Serve the pipe connection using provided codec
 		go s.ServeConn(ctx, sConn, cf)
 
@@ -126,12 +142,44 @@ func TestCodecs(t *testing.T) {
 		if add != 4 {
 			t.Errorf("codec/%s: add: expected 4, got %d", name, add)
 		}
+
+		// Gob can't encode the nil return value of
+		// methods that create channels
+		if strings.HasSuffix(name, "gob") {
+			return
+		}
+
+		// Call Counter.Count(), which returns a channel
+		countCh := make(chan int, 10)
+		err = c.Call(ctx, "Counter", "Count", 10, countCh)
+		if err != nil {
+			t.Errorf("codec/%s: %v", name, err)
+			return
+		}
+
+		var i int
+		for n := range countCh {
+			if n != i {
+				t.Errorf("codec/%s: count: expected %d, got %d", name, i, n)
+			}
+			i++
+		}
+
+		if i != 10 {
+			t.Errorf("codec/%s: count: expected 10 values, got %d", name, i)
+		}
 	}
 
 	// Test all codecs
 	testCodec(codec.Msgpack, "msgpack")
 	testCodec(codec.JSON, "json")
 	testCodec(codec.Gob, "gob")
+	testCodec(codec.CBOR, "cbor")
+	testCodec(codec.DeterministicCBOR, "cbor-deterministic")
+	testCodec(codec.Framed(codec.MsgpackCodec{}, 0), "framed-msgpack")
+	testCodec(codec.Framed(codec.JsonCodec{}, 0), "framed-json")
+	testCodec(codec.Framed(codec.GobCodec{}, 0), "framed-gob")
+	testCodec(codec.Framed(codec.CborCodec{}, 0), "framed-cbor")
 }
 
 type Channel struct{}
@@ -210,3 +258,2432 @@ func TestChannel(t *testing.T) {
 		loops++
 	}
 }
+
+func TestInterceptors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	defer s.Close()
+	// Register Arith and Channel for RPC
+	s.Register(Arith{})
+	s.Register(Channel{})
+
+	var called []string
+	var calledChannel bool
+	s.Use(func(ctx *server.Context, rcvr, method string, arg interface{}, next server.Handler) (interface{}, error) {
+		called = append(called, rcvr+"."+method)
+
+		switch method {
+		case "Mul":
+			// Short-circuit Arith.Mul
+			return nil, errors.New("mul disabled")
+		case "Add":
+			// Rewrite Arith.Add result
+			out, err := next(ctx, arg)
+			return out.(int) * 2, err
+		}
+
+		out, err := next(ctx, arg)
+		if ctx.IsChannel() {
+			calledChannel = true
+		}
+		return out, err
+	})
+
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	var add int
+	err := c.Call(ctx, "Arith", "Add", [2]int{2, 3}, &add)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if add != 10 {
+		t.Errorf("add: expected 10, got %d", add)
+	}
+
+	var mul int
+	err = c.Call(ctx, "Arith", "Mul", [2]int{2, 3}, &mul)
+	if err == nil || err.Error() != "mul disabled" {
+		t.Errorf("mul: expected mul disabled error, got %v", err)
+	}
+
+	timeCtx, timeCancel := context.WithCancel(ctx)
+	defer timeCancel()
+
+	timeCh := make(chan *time.Time, 2)
+	err = c.Call(timeCtx, "Channel", "Time", time.Millisecond, timeCh)
+	if err != nil {
+		t.Error(err)
+	}
+	<-timeCh
+
+	if !calledChannel {
+		t.Error("interceptor was not called for channel method")
+	}
+
+	if len(called) != 3 {
+		t.Errorf("expected 3 intercepted calls, got %v", called)
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	defer s.Close()
+	// Register Arith and Cancel for RPC
+	s.Register(Arith{})
+	rcvr := Cancel{done: make(chan error, 1)}
+	s.Register(rcvr)
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	var (
+		calledMtx sync.Mutex
+		called    []string
+	)
+	// Create new client using default codec and an interceptor
+	// that rewrites the argument and retries failed calls
+	c := client.New(cConn, codec.Default, client.WithInterceptors(
+		func(ctx context.Context, rcvr, method string, arg, ret interface{}, next client.Invoker) error {
+			calledMtx.Lock()
+			called = append(called, rcvr+"."+method)
+			calledMtx.Unlock()
+			if method == "Add" {
+				arg = [2]int{10, 10}
+			}
+
+			err := next(ctx, rcvr, method, arg, ret)
+			if err != nil && method == "Nonexistent" {
+				return next(ctx, "Arith", "Sub", arg, ret)
+			}
+			return err
+		},
+	))
+	defer c.Close()
+
+	var add int
+	err := c.Call(ctx, "Arith", "Add", [2]int{2, 3}, &add)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if add != 20 {
+		t.Errorf("add: expected 20, got %d", add)
+	}
+
+	var sub int
+	err = c.Call(ctx, "Arith", "Nonexistent", [2]int{5, 3}, &sub)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if sub != 2 {
+		t.Errorf("sub: expected 2, got %d", sub)
+	}
+
+	// Batches are intercepted once as a whole
+	var batchSum int
+	err = c.Batch(ctx, []*client.BatchCall{
+		{Receiver: "Arith", Method: "Add", Arg: [2]int{1, 1}, Ret: &batchSum},
+	}, false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if batchSum != 2 {
+		t.Errorf("batch: expected 2, got %d", batchSum)
+	}
+
+	// Canceling a call sends lrpc.CancelCall,
+	// which shouldn't be intercepted
+	callCtx, callCancel := context.WithCancel(ctx)
+	time.AfterFunc(10*time.Millisecond, callCancel)
+	c.Call(callCtx, "Cancel", "Wait", nil, nil)
+
+	select {
+	case <-rcvr.done:
+	case <-time.After(time.Second):
+		t.Fatal("server context was not canceled")
+	}
+
+	calledMtx.Lock()
+	defer calledMtx.Unlock()
+	expected := []string{"Arith.Add", "Arith.Nonexistent", "lrpc.Batch", "Cancel.Wait"}
+	if strings.Join(called, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected intercepted calls %v, got %v", expected, called)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	var panicErr *server.PanicError
+	s := server.New(server.WithPanicHandler(func(_ *server.Context, rcvr, method string, err *server.PanicError) {
+		panicErr = err
+	}))
+	defer s.Close()
+	// Register Arith for RPC
+	s.Register(Arith{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	// Call Arith.Div() with a zero divisor
+	var div int
+	err := c.Call(ctx, "Arith", "Div", [2]int{5, 0}, &div)
+	if err == nil || !strings.HasPrefix(err.Error(), server.ErrPanic.Error()) {
+		t.Errorf("expected panic error, got %v", err)
+	}
+
+	if panicErr == nil || len(panicErr.Stack) == 0 {
+		t.Errorf("expected panic handler to receive stack trace, got %v", panicErr)
+	}
+
+	// Make sure the server is still running
+	var add int
+	err = c.Call(ctx, "Arith", "Add", [2]int{5, 5}, &add)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if add != 10 {
+		t.Errorf("add: expected 10, got %d", add)
+	}
+}
+
+type Deadline struct{}
+
+func (Deadline) Wait(ctx *server.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return errors.New("no deadline set")
+	}
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestDeadline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	defer s.Close()
+	// Register Deadline for RPC
+	s.Register(Deadline{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer timeoutCancel()
+
+	err := c.Call(timeoutCtx, "Deadline", "Wait", nil, nil)
+	if err == nil || err.Error() != context.DeadlineExceeded.Error() {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+	}
+}
+
+type Cancel struct {
+	done chan error
+}
+
+func (c Cancel) Wait(ctx *server.Context) error {
+	<-ctx.Done()
+	c.done <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	defer s.Close()
+	// Register Cancel for RPC
+	rcvr := Cancel{done: make(chan error, 1)}
+	s.Register(rcvr)
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	callCtx, callCancel := context.WithCancel(ctx)
+	time.AfterFunc(20*time.Millisecond, callCancel)
+
+	err := c.Call(callCtx, "Cancel", "Wait", nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled error, got %v", err)
+	}
+
+	select {
+	case err = <-rcvr.done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected server context to be canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("server context was not canceled")
+	}
+}
+
+func TestImmediateCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	defer s.Close()
+	// Register Cancel for RPC
+	rcvr := Cancel{done: make(chan error, 50)}
+	s.Register(rcvr)
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	for i := 0; i < 50; i++ {
+		// The cancellation is sent right after the call,
+		// so it must not be handled before the call starts
+		callCtx, callCancel := context.WithCancel(ctx)
+		callCancel()
+		c.Call(callCtx, "Cancel", "Wait", nil, nil)
+
+		select {
+		case <-rcvr.done:
+		case <-time.After(time.Second):
+			t.Fatalf("call %d: server context was not canceled", i)
+		}
+	}
+}
+
+func TestCancelOtherConn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := server.New()
+	defer s.Close()
+	// Register Cancel for RPC
+	rcvr := Cancel{done: make(chan error, 1)}
+	s.Register(rcvr)
+
+	// Start a call with a known ID on the first connection
+	sConn1, cConn1 := net.Pipe()
+	go s.ServeConn(ctx, sConn1, codec.Default)
+	c1 := codec.Default(cConn1)
+	go func() {
+		var res types.Response
+		for c1.Decode(&res) == nil {
+		}
+	}()
+	err := c1.Encode(types.Request{
+		ID:       "1",
+		Receiver: "Cancel",
+		Method:   "Wait",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Try to cancel it from a second connection. CancelCall
+	// doesn't return anything, so the result is ignored.
+	sConn2, cConn2 := net.Pipe()
+	go s.ServeConn(ctx, sConn2, codec.Default)
+	c2 := client.New(cConn2, codec.Default)
+	defer c2.Close()
+	c2.Call(ctx, "lrpc", "CancelCall", "1", nil)
+
+	select {
+	case <-rcvr.done:
+		t.Fatal("call was canceled by another connection")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The first connection should still be able to cancel it
+	arg, err := c1.Marshal("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c1.Encode(types.Request{
+		ID:       "2",
+		Receiver: "lrpc",
+		Method:   "CancelCall",
+		Arg:      arg,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-rcvr.done:
+	case <-time.After(time.Second):
+		t.Fatal("call was not canceled")
+	}
+}
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrGone     = errors.New("gone")
+)
+
+// goneError matches both ErrNotFound and ErrGone
+type goneError struct{}
+
+func (goneError) Error() string {
+	return "gone"
+}
+
+func (goneError) Is(target error) bool {
+	return target == ErrNotFound || target == ErrGone
+}
+
+type ValidationError struct {
+	Field string
+}
+
+func (ve *ValidationError) Error() string {
+	return "invalid field: " + ve.Field
+}
+
+type Errors struct{}
+
+func (Errors) Sentinel(ctx *server.Context) error {
+	return fmt.Errorf("user 1: %w", ErrNotFound)
+}
+
+func (Errors) Typed(ctx *server.Context) error {
+	return &ValidationError{Field: "name"}
+}
+
+func (Errors) Coded(ctx *server.Context) error {
+	return errs.New("custom", "custom error")
+}
+
+func TestErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs.Register("not_found", ErrNotFound)
+	errs.Register("gone", ErrGone)
+	errs.RegisterType("validation", &ValidationError{})
+
+	// Errors matching several registered errors should
+	// always get the code of the first one
+	for i := 0; i < 100; i++ {
+		if code := errs.From(goneError{}).Code; code != "not_found" {
+			t.Fatalf("expected not_found code, got %s", code)
+		}
+	}
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	defer s.Close()
+	// Register Errors for RPC
+	s.Register(Errors{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	err := c.Call(ctx, "Errors", "Sentinel", nil, nil)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+
+	if err.Error() != "user 1: not found" {
+		t.Errorf("expected message to be preserved, got %q", err.Error())
+	}
+
+	err = c.Call(ctx, "Errors", "Typed", nil, nil)
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Errorf("expected validation error, got %v", err)
+	} else if ve.Field != "name" {
+		t.Errorf("expected field name, got %q", ve.Field)
+	}
+
+	err = c.Call(ctx, "Errors", "Coded", nil, nil)
+	if !errors.Is(err, errs.New("custom", "")) {
+		t.Errorf("expected custom error, got %v", err)
+	}
+
+	err = c.Call(ctx, "Errors", "Nonexistent", nil, nil)
+	if !errors.Is(err, server.ErrNoSuchMethod) {
+		t.Errorf("expected no such method error, got %v", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	defer s.Close()
+	// Register Arith for RPC
+	s.Register(Arith{})
+	// Echo the request ID back to the client
+	s.Use(func(ctx *server.Context, rcvr, method string, arg interface{}, next server.Handler) (interface{}, error) {
+		if ctx.GetMetadata("token") != "secret" {
+			return nil, errors.New("invalid token")
+		}
+		ctx.SetMetadata("request-id", ctx.GetMetadata("request-id"))
+		return next(ctx, arg)
+	})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	respMeta := client.Metadata{}
+	callCtx := client.WithMetadata(ctx, client.Metadata{"token": "secret"})
+	callCtx = client.WithMetadata(callCtx, client.Metadata{"request-id": "1234"})
+	callCtx = client.WithResponseMetadata(callCtx, respMeta)
+
+	var add int
+	err := c.Call(callCtx, "Arith", "Add", [2]int{5, 5}, &add)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if respMeta["request-id"] != "1234" {
+		t.Errorf("expected request ID 1234 in response metadata, got %q", respMeta["request-id"])
+	}
+
+	// The same context can be used for several calls at once
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var add int
+			c.Call(callCtx, "Arith", "Add", [2]int{5, 5}, &add)
+		}()
+	}
+	wg.Wait()
+
+	err = c.Call(ctx, "Arith", "Add", [2]int{5, 5}, &add)
+	if err == nil {
+		t.Error("expected error for call without token")
+	}
+}
+
+type Upload struct{}
+
+func (Upload) Sum(ctx *server.Context, in <-chan int) int {
+	var sum int
+	for n := range in {
+		sum += n
+	}
+	return sum
+}
+
+// First returns the first value sent by the client,
+// without waiting for the client to close its channel
+func (Upload) First(ctx *server.Context, in <-chan int) int {
+	return <-in
+}
+
+// Ignore never receives from the client's channel
+func (Upload) Ignore(ctx *server.Context, in <-chan int) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestClientChannel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	defer s.Close()
+	// Register Upload for RPC
+	s.Register(Upload{})
+	s.Register(Arith{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	in := make(chan int)
+	go func() {
+		for i := 1; i <= 10; i++ {
+			in <- i
+		}
+		close(in)
+	}()
+
+	var sum int
+	err := c.Call(ctx, "Upload", "Sum", in, &sum)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if sum != 55 {
+		t.Errorf("sum: expected 55, got %d", sum)
+	}
+
+	// Calling a method that doesn't accept a channel should fail
+	var add int
+	err = c.Call(ctx, "Arith", "Add", make(chan int), &add)
+	if !errors.Is(err, server.ErrUnexpectedChannel) {
+		t.Errorf("expected unexpected channel error, got %v", err)
+	}
+	if errors.Is(err, server.ErrArgNotChannel) {
+		t.Errorf("unexpected channel error matched arg not channel error")
+	}
+}
+
+type Chat struct{}
+
+func (Chat) Upper(ctx *server.Context) error {
+	st, err := ctx.MakeStream()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			var msg string
+			err := st.Recv(&msg)
+			if err != nil {
+				st.CloseSend()
+				return
+			}
+			st.Send(strings.ToUpper(msg))
+		}
+	}()
+
+	return nil
+}
+
+func TestStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	defer s.Close()
+	// Register Chat for RPC
+	s.Register(Chat{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	st, err := c.Stream(ctx, "Chat", "Upper", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	for _, msg := range []string{"hello", "world"} {
+		err = st.Send(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var resp string
+		err = st.Recv(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp != strings.ToUpper(msg) {
+			t.Errorf("expected %q, got %q", strings.ToUpper(msg), resp)
+		}
+	}
+
+	// Close our side, which should cause the server to close its side
+	err = st.CloseSend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp string
+	err = st.Recv(&resp)
+	if err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	err = st.Send("test")
+	if !errors.Is(err, client.ErrStreamClosed) {
+		t.Errorf("expected stream closed error, got %v", err)
+	}
+}
+
+type Counter struct{}
+
+func (Counter) Count(ctx *server.Context, n int) error {
+	ch, err := ctx.MakeChannel()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer close(ch)
+		for i := 0; i < n; i++ {
+			select {
+			case ch <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Window creates a channel with the given window
+func (Counter) Window(ctx *server.Context, window int) error {
+	_, err := ctx.MakeChannelWindow(window)
+	return err
+}
+
+func TestFlowControl(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New(server.WithChannelWindow(2))
+	defer s.Close()
+	// Register Counter and Arith for RPC
+	s.Register(Counter{})
+	s.Register(Arith{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec and a small window
+	c := client.New(cConn, codec.Default, client.WithChannelWindow(2))
+	defer c.Close()
+
+	// Create a channel, but don't read from it yet
+	countCh := make(chan int)
+	err := c.Call(ctx, "Counter", "Count", 100, countCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other calls should not be blocked by the slow consumer
+	addCtx, addCancel := context.WithTimeout(ctx, time.Second)
+	defer addCancel()
+
+	var add int
+	err = c.Call(addCtx, "Arith", "Add", [2]int{5, 5}, &add)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if add != 10 {
+		t.Errorf("add: expected 10, got %d", add)
+	}
+
+	// All values should still arrive in order
+	var expected int
+	for n := range countCh {
+		if n != expected {
+			t.Fatalf("expected %d, got %d", expected, n)
+		}
+		expected++
+	}
+
+	if expected != 100 {
+		t.Errorf("expected 100 values, got %d", expected)
+	}
+
+	// Negative windows should be rejected
+	err = c.Call(ctx, "Counter", "Window", -1, nil)
+	if err == nil || !strings.Contains(err.Error(), server.ErrInvalidWindow.Error()) {
+		t.Errorf("expected invalid window error, got %v", err)
+	}
+}
+
+func TestZeroWindow(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	// Windows smaller than 1 should be treated as 1
+	s := server.New(server.WithChannelWindow(0))
+	defer s.Close()
+	// Register Counter and Upload for RPC
+	s.Register(Counter{})
+	s.Register(Upload{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default, client.WithChannelWindow(0))
+	defer c.Close()
+
+	countCh := make(chan int)
+	err := c.Call(ctx, "Counter", "Count", 100, countCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	for range countCh {
+		count++
+	}
+
+	if count != 100 {
+		t.Errorf("expected 100 values, got %d", count)
+	}
+
+	in := make(chan int)
+	go func() {
+		defer close(in)
+		for i := 1; i <= 10; i++ {
+			in <- i
+		}
+	}()
+
+	var sum int
+	err = c.Call(ctx, "Upload", "Sum", in, &sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sum != 55 {
+		t.Errorf("expected 55, got %d", sum)
+	}
+}
+
+func TestFlowControlViolation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+	defer cConn.Close()
+
+	s := server.New(server.WithChannelWindow(1))
+	defer s.Close()
+	// Register Upload for RPC
+	s.Register(Upload{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Read responses in the background, so
+	// that the server never blocks sending
+	c := codec.Default(cConn)
+	errCh := make(chan *types.Error, 1)
+	go func() {
+		for {
+			var res types.Response
+			if c.Decode(&res) != nil {
+				return
+			}
+			if res.Type == types.ResponseTypeError && res.ID == "" {
+				errCh <- res.Error
+			}
+		}
+	}()
+
+	// Send a channel to a method that never receives from it,
+	// followed by more values than the window allows, ignoring
+	// the credits granted by the server
+	err := c.Encode(types.Request{
+		Type:     types.RequestTypeChannel,
+		ID:       "1",
+		Receiver: "Upload",
+		Method:   "Ignore",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arg, err := c.Marshal(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		err = c.Encode(types.Request{
+			Type: types.RequestTypeChannelValue,
+			ID:   "1",
+			Arg:  arg,
+		})
+		if err != nil {
+			// The server closed the connection
+			break
+		}
+	}
+
+	// The server should send a connection error
+	// instead of blocking its read loop
+	select {
+	case e := <-errCh:
+		if e.Code != string(errs.CodeFlowControl) {
+			t.Errorf("expected flow control error, got %v", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("server did not send a flow control error")
+	}
+}
+
+type Shutdown struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s Shutdown) Wait(ctx *server.Context) (string, error) {
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+		return "done", nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	// Register Shutdown and Arith for RPC
+	rcvr := Shutdown{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	s.Register(rcvr)
+	s.Register(Arith{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	// Start a call that waits until it's released
+	callErr := make(chan error, 1)
+	var out string
+	go func() {
+		callErr <- c.Call(ctx, "Shutdown", "Wait", nil, &out)
+	}()
+	<-rcvr.started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(ctx)
+	}()
+
+	// The client should be told that the server is going away
+	select {
+	case <-c.GoingAway():
+	case <-time.After(time.Second):
+		t.Fatal("client was not told that the server is going away")
+	}
+
+	// New calls should be rejected
+	var add int
+	err := c.Call(ctx, "Arith", "Add", [2]int{1, 2}, &add)
+	if !errors.Is(err, server.ErrShuttingDown) {
+		t.Errorf("expected shutting down error, got %v", err)
+	}
+
+	// Shutdown should wait for the in-progress call
+	select {
+	case err = <-shutdownErr:
+		t.Fatalf("shutdown returned before call finished: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(rcvr.release)
+
+	err = <-callErr
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out != "done" {
+		t.Errorf("expected done, got %s", out)
+	}
+
+	select {
+	case err = <-shutdownErr:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("shutdown did not return after call finished")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	// Register Shutdown for RPC
+	rcvr := Shutdown{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	s.Register(rcvr)
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	// Start a call that never finishes on its own
+	go c.Call(ctx, "Shutdown", "Wait", nil, nil)
+	<-rcvr.started
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer shutdownCancel()
+
+	err := s.Shutdown(shutdownCtx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+	}
+}
+
+type Events struct {
+	recorded chan int
+}
+
+func (e Events) Record(ctx *server.Context, n int) error {
+	if !ctx.IsNotification() {
+		return errors.New("expected notification")
+	}
+	e.recorded <- n
+	return errors.New("this error should not be sent")
+}
+
+func TestNotify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	defer s.Close()
+	// Register Events and Arith for RPC
+	rcvr := Events{recorded: make(chan int, 3)}
+	s.Register(rcvr)
+	s.Register(Arith{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		err := c.Notify(ctx, "Events", "Record", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every notification should be received by the server
+	for i := 0; i < 3; i++ {
+		select {
+		case <-rcvr.recorded:
+		case <-time.After(time.Second):
+			t.Fatal("notification was not received")
+		}
+	}
+
+	// Normal calls should be unaffected
+	var add int
+	err := c.Call(ctx, "Arith", "Add", [2]int{2, 2}, &add)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if add != 4 {
+		t.Errorf("add: expected 4, got %d", add)
+	}
+
+	err = c.Notify(ctx, "Events", "Record", make(chan int))
+	if err != client.ErrNotifyChannel {
+		t.Errorf("expected notify channel error, got %v", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	defer s.Close()
+	// Register Arith, Channel, and Errors for RPC
+	s.Register(Arith{})
+	s.Register(Channel{})
+	s.Register(Errors{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	for _, concurrent := range []bool{false, true} {
+		sums := make([]int, 10)
+		var calls []*client.BatchCall
+		for i := range sums {
+			calls = append(calls, &client.BatchCall{
+				Receiver: "Arith",
+				Method:   "Add",
+				Arg:      [2]int{i, i},
+				Ret:      &sums[i],
+			})
+		}
+
+		// Add calls that fail, to make sure errors
+		// are returned for each call separately
+		calls = append(calls,
+			&client.BatchCall{Receiver: "Errors", Method: "Coded"},
+			&client.BatchCall{Receiver: "Arith", Method: "Nonexistent"},
+			&client.BatchCall{Receiver: "Channel", Method: "Time", Arg: time.Millisecond},
+		)
+
+		err := c.Batch(ctx, calls, concurrent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, sum := range sums {
+			if calls[i].Err != nil {
+				t.Errorf("call %d: %v", i, calls[i].Err)
+			}
+			if sum != i*2 {
+				t.Errorf("call %d: expected %d, got %d", i, i*2, sum)
+			}
+		}
+
+		if !errors.Is(calls[10].Err, errs.New("custom", "")) {
+			t.Errorf("expected custom error, got %v", calls[10].Err)
+		}
+
+		if !errors.Is(calls[11].Err, server.ErrNoSuchMethod) {
+			t.Errorf("expected no such method error, got %v", calls[11].Err)
+		}
+
+		if !errors.Is(calls[12].Err, server.ErrBatchChannel) {
+			t.Errorf("expected batch channel error, got %v", calls[12].Err)
+		}
+		if errors.Is(calls[12].Err, server.ErrInvalidMethod) {
+			t.Errorf("batch channel error matched invalid method error")
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := server.New()
+	defer s.Close()
+	// Register Shutdown, Arith, and Channel for RPC
+	rcvr := Shutdown{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	s.Register(rcvr)
+	s.Register(Arith{})
+	s.Register(Channel{})
+
+	// Create a dialer that creates a new network pipe
+	// every time, and keeps the server's side of it
+	conns := make(chan net.Conn, 10)
+	dial := func(ctx context.Context) (io.ReadWriteCloser, error) {
+		sConn, cConn := net.Pipe()
+		conns <- sConn
+		// Serve the pipe connection using default codec
+		go s.ServeConn(ctx, sConn, codec.Default)
+		return cConn, nil
+	}
+
+	states := make(chan client.State, 10)
+	c, err := client.Dial(
+		ctx,
+		dial,
+		codec.Default,
+		client.WithBackoff(time.Millisecond, 10*time.Millisecond),
+		client.WithResubscribe(),
+		client.WithStateHandler(func(s client.State) {
+			states <- s
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Start a call that won't finish on its own
+	callErr := make(chan error, 1)
+	go func() {
+		callErr <- c.Call(ctx, "Shutdown", "Wait", nil, nil)
+	}()
+	<-rcvr.started
+
+	// Start a channel call
+	timeCh := make(chan time.Time, 1)
+	err = c.Call(ctx, "Channel", "Time", time.Millisecond, timeCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-timeCh
+
+	// Close the server's side of the connection
+	conn := <-conns
+	conn.Close()
+
+	// The call in progress should fail
+	select {
+	case err = <-callErr:
+		if !errors.Is(err, client.ErrConnectionLost) {
+			t.Errorf("expected connection lost error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call did not fail after connection was lost")
+	}
+
+	// The client should reconnect
+	for _, expected := range []client.State{client.StateReconnecting, client.StateConnected} {
+		select {
+		case state := <-states:
+			if state != expected {
+				t.Fatalf("expected state %s, got %s", expected, state)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("state did not change to %s", expected)
+		}
+	}
+
+	// New calls should work
+	var add int
+	err = c.Call(ctx, "Arith", "Add", [2]int{3, 4}, &add)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if add != 7 {
+		t.Errorf("add: expected 7, got %d", add)
+	}
+
+	// The channel should keep receiving values
+	// once it's resubscribed
+	timeout := time.After(time.Second)
+	for i := 0; i < 5; i++ {
+		select {
+		case _, ok := <-timeCh:
+			if !ok {
+				t.Fatal("channel was closed")
+			}
+		case <-timeout:
+			t.Fatal("channel did not receive values after reconnecting")
+		}
+	}
+}
+
+func TestConnectionClosed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	defer s.Close()
+	// Register Shutdown and Channel for RPC
+	rcvr := Shutdown{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	s.Register(rcvr)
+	s.Register(Channel{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	// Start a call that won't finish on its own
+	callErr := make(chan error, 1)
+	go func() {
+		callErr <- c.Call(ctx, "Shutdown", "Wait", nil, nil)
+	}()
+	<-rcvr.started
+
+	// Start a channel call
+	timeCh := make(chan time.Time, 1)
+	err := c.Call(ctx, "Channel", "Time", time.Millisecond, timeCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Err() != nil {
+		t.Errorf("expected no error before connection is closed, got %v", c.Err())
+	}
+
+	// Close the server's side of the connection
+	sConn.Close()
+
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("client was not closed after connection was lost")
+	}
+
+	if !errors.Is(c.Err(), client.ErrConnectionClosed) {
+		t.Errorf("expected connection closed error, got %v", c.Err())
+	}
+
+	// The call in progress should fail
+	err = <-callErr
+	if !errors.Is(err, client.ErrConnectionClosed) {
+		t.Errorf("expected connection closed error, got %v", err)
+	}
+
+	// The channel should be closed
+	for range timeCh {
+	}
+
+	// New calls should fail
+	err = c.Call(ctx, "Channel", "Time", time.Millisecond, timeCh)
+	if !errors.Is(err, client.ErrConnectionClosed) {
+		t.Errorf("expected connection closed error, got %v", err)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New(server.WithKeepalive(20*time.Millisecond, 500*time.Millisecond))
+	defer s.Close()
+	// Register Arith for RPC
+	s.Register(Arith{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default, client.WithKeepalive(20*time.Millisecond, 500*time.Millisecond))
+	defer c.Close()
+
+	// The connection should stay alive while both sides respond
+	time.Sleep(200 * time.Millisecond)
+
+	var add int
+	err := c.Call(ctx, "Arith", "Add", [2]int{1, 1}, &add)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if add != 2 {
+		t.Errorf("add: expected 2, got %d", add)
+	}
+}
+
+func TestClientKeepaliveTimeout(t *testing.T) {
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+	defer sConn.Close()
+
+	// Read everything the client sends, without responding
+	go io.Copy(io.Discard, sConn)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default, client.WithKeepalive(5*time.Millisecond, 20*time.Millisecond))
+	defer c.Close()
+
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("client was not closed after server stopped responding")
+	}
+
+	if !errors.Is(c.Err(), client.ErrConnectionClosed) {
+		t.Errorf("expected connection closed error, got %v", c.Err())
+	}
+}
+
+func TestServerKeepaliveTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+	defer cConn.Close()
+
+	s := server.New(server.WithKeepalive(5*time.Millisecond, 20*time.Millisecond))
+	defer s.Close()
+	// Register Cancel for RPC
+	rcvr := Cancel{done: make(chan error, 1)}
+	s.Register(rcvr)
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Start a call, and then stop reading from the connection,
+	// like a client whose connection was lost
+	err := codec.Default(cConn).Encode(types.Request{
+		ID:       "1",
+		Receiver: "Cancel",
+		Method:   "Wait",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The call should be canceled once the connection is closed
+	select {
+	case err = <-rcvr.done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected server context to be canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("server context was not canceled")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New(server.WithIdleTimeout(50 * time.Millisecond))
+	defer s.Close()
+	// Register Arith for RPC
+	s.Register(Arith{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	var add int
+	err := c.Call(ctx, "Arith", "Add", [2]int{1, 1}, &add)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server should close the connection once it's idle
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+}
+
+type ConnState struct{}
+
+func (ConnState) User(ctx *server.Context) (string, error) {
+	if ctx.Conn().Transport() != server.TransportConn {
+		return "", fmt.Errorf("unexpected transport: %s", ctx.Conn().Transport())
+	}
+
+	if ctx.Conn().RemoteAddr() == nil {
+		return "", errors.New("expected remote address")
+	}
+
+	user, ok := ctx.Conn().Get("user")
+	if !ok {
+		return "", errors.New("user not set")
+	}
+	return user.(string), nil
+}
+
+func TestConnHooks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	defer s.Close()
+	// Register ConnState for RPC
+	s.Register(ConnState{})
+
+	s.OnConnect(func(conn *server.Conn) {
+		conn.Set("user", "admin")
+	})
+
+	disconnected := make(chan string, 1)
+	s.OnDisconnect(func(conn *server.Conn) {
+		user, _ := conn.Get("user")
+		disconnected <- user.(string)
+	})
+
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+
+	var user string
+	err := c.Call(ctx, "ConnState", "User", nil, &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user != "admin" {
+		t.Errorf("expected admin, got %s", user)
+	}
+
+	c.Close()
+
+	select {
+	case user = <-disconnected:
+		if user != "admin" {
+			t.Errorf("expected admin, got %s", user)
+		}
+	case <-time.After(time.Second):
+		t.Error("disconnect hook was not called")
+	}
+}
+
+type Whoami struct{}
+
+func (Whoami) Name(ctx *server.Context) (string, error) {
+	if ctx.Identity() == nil {
+		return "", errors.New("not authenticated")
+	}
+	return ctx.Identity().Name, nil
+}
+
+func TestAuth(t *testing.T) {
+	tokenAuth := server.TokenAuthenticator(func(token string) (*server.Identity, error) {
+		if token != "secret" {
+			return nil, errors.New("invalid token")
+		}
+		return &server.Identity{Name: "token-user"}, nil
+	})
+
+	hmacAuth := server.HMACAuthenticator(func(id string) ([]byte, error) {
+		if id != "hmac-user" {
+			return nil, errors.New("unknown client")
+		}
+		return []byte("key"), nil
+	})
+
+	type test struct {
+		name  string
+		auth  server.Authenticator
+		creds client.Credentials
+		// expected is the expected identity name,
+		// or empty if authentication should fail
+		expected string
+	}
+
+	tests := []test{
+		{"token", tokenAuth, client.TokenCredentials("secret"), "token-user"},
+		{"bad-token", tokenAuth, client.TokenCredentials("wrong"), ""},
+		{"hmac", hmacAuth, client.HMACCredentials("hmac-user", []byte("key")), "hmac-user"},
+		{"bad-hmac", hmacAuth, client.HMACCredentials("hmac-user", []byte("wrong")), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Create new network pipe
+			sConn, cConn := net.Pipe()
+
+			s := server.New(server.WithAuthenticator(tt.auth))
+			defer s.Close()
+			// Register Whoami for RPC
+			s.Register(Whoami{})
+			// Serve the pipe connection using default codec
+			go s.ServeConn(ctx, sConn, codec.Default)
+
+			// Create new client using default codec
+			c := client.New(cConn, codec.Default, client.WithCredentials(tt.creds))
+			defer c.Close()
+
+			var name string
+			err := c.Call(ctx, "Whoami", "Name", nil, &name)
+
+			if tt.expected == "" {
+				if !errors.Is(err, client.ErrConnectionClosed) {
+					t.Errorf("expected connection closed error, got %v", err)
+				}
+				if !errors.Is(c.Err(), server.ErrUnauthenticated) {
+					t.Errorf("expected unauthenticated error, got %v", c.Err())
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if name != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, name)
+			}
+		})
+	}
+}
+
+func TestServerFirstAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The server sends a greeting, and the client
+	// must send it back to be authenticated
+	auth := server.AuthenticatorFunc(func(ex *server.AuthExchange) (*server.Identity, error) {
+		err := ex.Send("hello")
+		if err != nil {
+			return nil, err
+		}
+
+		var greeting string
+		err = ex.Recv(&greeting)
+		if err != nil {
+			return nil, err
+		}
+		return &server.Identity{Name: greeting}, nil
+	})
+
+	creds := client.CredentialsFunc(func(ex *client.AuthExchange) error {
+		var greeting string
+		err := ex.Recv(&greeting)
+		if err != nil {
+			return err
+		}
+		return ex.Send(greeting)
+	})
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	// The client doesn't perform the handshake, so the server
+	// can't wait for it before the authenticator runs
+	s := server.New(server.WithAuthenticator(auth), server.WithoutHandshake())
+	defer s.Close()
+	// Register Whoami for RPC
+	s.Register(Whoami{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	done := make(chan *client.Client, 1)
+	go func() {
+		done <- client.New(cConn, codec.Default, client.WithCredentials(creds))
+	}()
+
+	var c *client.Client
+	select {
+	case c = <-done:
+	case <-time.After(time.Second):
+		cConn.Close()
+		t.Fatal("authentication did not finish")
+	}
+	defer c.Close()
+
+	var name string
+	err := c.Call(ctx, "Whoami", "Name", nil, &name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "hello" {
+		t.Errorf("expected hello, got %s", name)
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	auth := server.TokenAuthenticator(func(token string) (*server.Identity, error) {
+		return &server.Identity{Name: token}, nil
+	})
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New(server.WithAuthenticator(auth), server.WithAuthTimeout(50*time.Millisecond))
+	defer s.Close()
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// The client never sends its credentials,
+	// so the server should close the connection
+	done := make(chan error, 1)
+	go func() {
+		_, err := cConn.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected connection to be closed")
+		}
+	case <-time.After(time.Second):
+		cConn.Close()
+		t.Fatal("connection was not closed")
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	auth := server.TokenAuthenticator(func(token string) (*server.Identity, error) {
+		return &server.Identity{
+			Name:  token,
+			Attrs: map[string]string{"role": token},
+		}, nil
+	})
+
+	type test struct {
+		token string
+		// allowed is whether the client should be
+		// allowed to call lrpc.IntrospectAll
+		allowed bool
+	}
+
+	tests := []test{
+		{"admin", true},
+		{"user", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Create new network pipe
+			sConn, cConn := net.Pipe()
+
+			s := server.New(server.WithAuthenticator(auth))
+			defer s.Close()
+			// Only allow admins to introspect the server
+			s.SetPolicy("lrpc", "IntrospectAll", server.RequireAttr("role", "admin"))
+			// Register Whoami for RPC, allowing any authenticated client
+			s.Register(Whoami{}, server.ReceiverPolicy(server.RequireIdentity()))
+			// Serve the pipe connection using default codec
+			go s.ServeConn(ctx, sConn, codec.Default)
+
+			// Create new client using default codec
+			c := client.New(cConn, codec.Default, client.WithCredentials(client.TokenCredentials(tt.token)))
+			defer c.Close()
+
+			var name string
+			err := c.Call(ctx, "Whoami", "Name", nil, &name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var desc map[string][]server.MethodDesc
+			err = c.Call(ctx, "lrpc", "IntrospectAll", nil, &desc)
+			if tt.allowed {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if !errors.Is(err, server.ErrPermissionDenied) {
+				t.Errorf("expected permission denied error, got %v", err)
+			}
+
+			// Calls in batches must be authorized as well
+			calls := []*client.BatchCall{
+				{Receiver: "Whoami", Method: "Name", Ret: &name},
+				{Receiver: "lrpc", Method: "IntrospectAll", Ret: &desc},
+			}
+			err = c.Batch(ctx, calls, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if calls[0].Err != nil {
+				t.Errorf("expected no error, got %v", calls[0].Err)
+			}
+
+			if tt.allowed {
+				if calls[1].Err != nil {
+					t.Errorf("expected no error, got %v", calls[1].Err)
+				}
+			} else if !errors.Is(calls[1].Err, server.ErrPermissionDenied) {
+				t.Errorf("expected permission denied error, got %v", calls[1].Err)
+			}
+		})
+	}
+}
+
+type Peer struct{}
+
+func (Peer) Subject(ctx *server.Context) (string, error) {
+	cert := ctx.PeerCertificate()
+	if cert == nil {
+		return "", errors.New("no verified certificate")
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// newCert creates a certificate with the given common name, signed
+// by parent, or self-signed if parent is nil
+func newCert(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create a CA that signs both the server's
+	// and the client's certificates
+	ca := newCert(t, "ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	serverCert := newCert(t, "server", &ca)
+	clientCert := newCert(t, "client", &ca)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.New(server.WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}))
+	defer s.Close()
+	// Register Peer for RPC
+	s.Register(Peer{})
+	// Serve the listener using default codec
+	go s.Serve(ctx, ln, codec.Default)
+
+	// Connect to the server using TLS with the client's certificate
+	c, err := client.Dial(ctx, client.TLSDialer("tcp", ln.Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      pool,
+		ServerName:   "server",
+	}), codec.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var subject string
+	err = c.Call(ctx, "Peer", "Subject", nil, &subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subject != "client" {
+		t.Errorf("expected client, got %s", subject)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	type test struct {
+		name string
+		opt  server.Option
+		// run makes calls using c, where rcvr
+		// is the registered Shutdown receiver
+		run func(t *testing.T, ctx context.Context, c *client.Client, rcvr Shutdown)
+	}
+
+	// call calls Arith.Add and returns the error
+	call := func(ctx context.Context, c *client.Client) error {
+		var sum int
+		return c.Call(ctx, "Arith", "Add", [2]int{1, 2}, &sum)
+	}
+
+	tests := []test{
+		{"concurrent-calls", server.WithMaxConcurrentCalls(1), func(t *testing.T, ctx context.Context, c *client.Client, rcvr Shutdown) {
+			// Start a call that doesn't finish until it's released
+			done := make(chan error, 1)
+			go func() {
+				var res string
+				done <- c.Call(ctx, "Shutdown", "Wait", nil, &res)
+			}()
+			<-rcvr.started
+
+			err := call(ctx, c)
+			if !errors.Is(err, server.ErrResourceExhausted) {
+				t.Errorf("expected resource exhausted error, got %v", err)
+			}
+
+			close(rcvr.release)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+
+			// Calls are allowed again once the first one is over
+			err = call(ctx, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A batch whose calls run one at a time is a single call,
+			// but every call in a concurrent batch counts
+			var a, b int
+			batch := []*client.BatchCall{
+				{Receiver: "Arith", Method: "Add", Arg: [2]int{1, 2}, Ret: &a},
+				{Receiver: "Arith", Method: "Add", Arg: [2]int{3, 4}, Ret: &b},
+			}
+			err = c.Batch(ctx, batch, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = c.Batch(ctx, batch, true)
+			if !errors.Is(err, server.ErrResourceExhausted) {
+				t.Errorf("expected resource exhausted error, got %v", err)
+			}
+		}},
+		{"workers", server.WithWorkers(1), func(t *testing.T, ctx context.Context, c *client.Client, rcvr Shutdown) {
+			// Start a call that uses the only worker
+			go c.Call(ctx, "Shutdown", "Wait", nil, nil)
+			<-rcvr.started
+
+			waitCtx, waitCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+			defer waitCancel()
+
+			err := call(waitCtx, c)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected deadline exceeded error, got %v", err)
+			}
+
+			close(rcvr.release)
+
+			// The worker is free again once the first call is over
+			err = call(ctx, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"no-workers", server.WithWorkers(0), func(t *testing.T, ctx context.Context, c *client.Client, _ Shutdown) {
+			// Calls shouldn't wait for a worker
+			callCtx, callCancel := context.WithTimeout(ctx, time.Second)
+			defer callCancel()
+
+			err := call(callCtx, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"method-rate", server.WithMethodRateLimit("Arith", "Add", 0.001, 2), func(t *testing.T, ctx context.Context, c *client.Client, _ Shutdown) {
+			for i := 0; i < 2; i++ {
+				err := call(ctx, c)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := call(ctx, c)
+			if !errors.Is(err, server.ErrResourceExhausted) {
+				t.Errorf("expected resource exhausted error, got %v", err)
+			}
+
+			// Other methods aren't limited
+			var product int
+			err = c.Call(ctx, "Arith", "Mul", [2]int{2, 3}, &product)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"client-rate", server.WithClientRateLimit(0.001, 2), func(t *testing.T, ctx context.Context, c *client.Client, _ Shutdown) {
+			err := call(ctx, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Every call in a batch counts towards the limit
+			var a, b int
+			err = c.Batch(ctx, []*client.BatchCall{
+				{Receiver: "Arith", Method: "Add", Arg: [2]int{1, 2}, Ret: &a},
+				{Receiver: "Arith", Method: "Add", Arg: [2]int{3, 4}, Ret: &b},
+			}, false)
+			if !errors.Is(err, server.ErrResourceExhausted) {
+				t.Errorf("expected resource exhausted error, got %v", err)
+			}
+
+			err = call(ctx, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = call(ctx, c)
+			if !errors.Is(err, server.ErrResourceExhausted) {
+				t.Errorf("expected resource exhausted error, got %v", err)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Create new network pipe
+			sConn, cConn := net.Pipe()
+
+			s := server.New(tt.opt)
+			defer s.Close()
+			// Register Arith and Shutdown for RPC
+			rcvr := Shutdown{
+				started: make(chan struct{}, 1),
+				release: make(chan struct{}),
+			}
+			s.Register(Arith{})
+			s.Register(rcvr)
+			// Serve the pipe connection using default codec
+			go s.ServeConn(ctx, sConn, codec.Default)
+
+			// Create new client using default codec
+			c := client.New(cConn, codec.Default)
+			defer c.Close()
+
+			tt.run(t, ctx, c, rcvr)
+		})
+	}
+}
+
+type Sizes struct{}
+
+func (Sizes) Len(ctx *server.Context, s string) int {
+	return len(s)
+}
+
+func (Sizes) Make(ctx *server.Context, n int) string {
+	return strings.Repeat("x", n)
+}
+
+func TestMessageSize(t *testing.T) {
+	type test struct {
+		name string
+		sOpt server.Option
+		cOpt client.Option
+		// run makes calls using c
+		run func(t *testing.T, ctx context.Context, c *client.Client)
+	}
+
+	// call calls Sizes.Len with a string of length n
+	call := func(ctx context.Context, c *client.Client, n int) error {
+		var out int
+		return c.Call(ctx, "Sizes", "Len", strings.Repeat("x", n), &out)
+	}
+
+	// waitClosed waits for c to be closed and checks
+	// that it was closed because of a message size limit
+	waitClosed := func(t *testing.T, c *client.Client) {
+		select {
+		case <-c.Done():
+		case <-time.After(time.Second):
+			t.Fatal("expected connection to be closed")
+		}
+
+		if !errors.Is(c.Err(), codec.ErrMessageTooLarge) {
+			t.Errorf("expected message too large error, got %v", c.Err())
+		}
+	}
+
+	tests := []test{
+		{"server-message", server.WithMaxMessageSize(1024), nil, func(t *testing.T, ctx context.Context, c *client.Client) {
+			err := call(ctx, c, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The connection is closed, as the rest
+			// of the message can't be skipped
+			err = call(ctx, c, 4096)
+			if err == nil {
+				t.Error("expected error, got nil")
+			}
+			waitClosed(t, c)
+		}},
+		{"server-arg", server.WithMaxArgSize(100), nil, func(t *testing.T, ctx context.Context, c *client.Client) {
+			err := call(ctx, c, 200)
+			if !errors.Is(err, server.ErrMessageTooLarge) {
+				t.Errorf("expected message too large error, got %v", err)
+			}
+
+			// The client can still make calls with smaller arguments
+			err = call(ctx, c, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Clients that keep sending arguments
+			// that are too large are disconnected
+			for i := 0; i < 2; i++ {
+				call(ctx, c, 200)
+			}
+			waitClosed(t, c)
+		}},
+		{"client-message", nil, client.WithMaxMessageSize(1024), func(t *testing.T, ctx context.Context, c *client.Client) {
+			var out string
+			err := c.Call(ctx, "Sizes", "Make", 4096, &out)
+			if err == nil {
+				t.Error("expected error, got nil")
+			}
+			waitClosed(t, c)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Create new network pipe
+			sConn, cConn := net.Pipe()
+
+			var sOpts []server.Option
+			if tt.sOpt != nil {
+				sOpts = append(sOpts, tt.sOpt)
+			}
+			s := server.New(sOpts...)
+			defer s.Close()
+			// Register Sizes for RPC
+			s.Register(Sizes{})
+			// Serve the pipe connection using default codec
+			go s.ServeConn(ctx, sConn, codec.Default)
+
+			var cOpts []client.Option
+			if tt.cOpt != nil {
+				cOpts = append(cOpts, tt.cOpt)
+			}
+			// Create new client using default codec
+			c := client.New(cConn, codec.Default, cOpts...)
+			defer c.Close()
+
+			tt.run(t, ctx, c)
+		})
+	}
+}
+
+func TestFramed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	// The message size limit shouldn't keep
+	// the codec from skipping large frames
+	s := server.New(server.WithMaxMessageSize(1024))
+	defer s.Close()
+	// Register Arith and Sizes for RPC
+	s.Register(Arith{})
+	s.Register(Sizes{})
+	// Serve the pipe connection using a framed codec
+	// with a smaller limit than the client's
+	go s.ServeConn(ctx, sConn, codec.Framed(codec.MsgpackCodec{}, 512))
+
+	// Create new client using framed codec
+	c := client.New(cConn, codec.Framed(codec.MsgpackCodec{}, 4096))
+	defer c.Close()
+
+	// frame creates a frame with the given payload
+	frame := func(payload []byte) []byte {
+		return append([]byte{1, 0, 0, byte(len(payload) >> 8), byte(len(payload))}, payload...)
+	}
+
+	// malformed is a request with an ID that
+	// isn't waiting for a response, followed by
+	// an invalid msgpack value
+	malformed := []byte{0x82, 0xa2, 'I', 'D', 0xa3, 'b', 'a', 'd'}
+	malformed = append(malformed, 0xa8)
+	malformed = append(malformed, "Receiver"...)
+	malformed = append(malformed, 0xc1)
+
+	frames := map[string][]byte{
+		"malformed": frame(malformed),
+		"unknown":   append([]byte{255, 0, 0, 0, 3}, "abc"...),
+	}
+
+	// checkAdd checks that the connection can still be used
+	checkAdd := func(t *testing.T) {
+		var add int
+		err := c.Call(ctx, "Arith", "Add", [2]int{2, 2}, &add)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if add != 4 {
+			t.Errorf("expected 4, got %d", add)
+		}
+	}
+
+	for name, data := range frames {
+		t.Run(name, func(t *testing.T) {
+			// Send the bad frame directly on the connection,
+			// which the server should skip
+			_, err := cConn.Write(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkAdd(t)
+		})
+	}
+
+	t.Run("too-large", func(t *testing.T) {
+		callCtx, callCancel := context.WithTimeout(ctx, time.Second)
+		defer callCancel()
+
+		// The server skips the request without reading its ID,
+		// so the call should fail instead of waiting forever
+		var out int
+		err := c.Call(callCtx, "Sizes", "Len", strings.Repeat("x", 1024), &out)
+		if !errors.Is(err, server.ErrMessageTooLarge) {
+			t.Errorf("expected message too large error, got %v", err)
+		}
+
+		checkAdd(t)
+	})
+}
+
+type Protocol struct{}
+
+func (Protocol) Codec(ctx *server.Context) string {
+	return ctx.Conn().Codec()
+}
+
+func TestHandshake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.New(server.WithCodecs("msgpack", "json"))
+	defer s.Close()
+	// Register Protocol for RPC
+	s.Register(Protocol{})
+	// Serve the listener, using JSON for clients
+	// that don't perform the handshake
+	go s.Serve(ctx, ln, codec.JSON)
+
+	dial := func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	}
+
+	type test struct {
+		name   string
+		codecs []string
+		// expected is the expected codec name,
+		// or empty if the handshake should fail
+		expected string
+	}
+
+	tests := []test{
+		{"msgpack", []string{"msgpack"}, "msgpack"},
+		{"json", []string{"json"}, "json"},
+		{"preference", []string{"gob", "json", "msgpack"}, "json"},
+		{"unsupported", []string{"gob"}, ""},
+		{"no-handshake", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []client.Option
+			if tt.codecs != nil {
+				opts = append(opts, client.WithCodecs(tt.codecs...))
+			}
+
+			// Clients that perform the handshake don't use
+			// this codec, so it's only used by the client
+			// that doesn't
+			c, err := client.Dial(ctx, dial, codec.JSON, opts...)
+			if tt.codecs != nil && tt.expected == "" {
+				if !errors.Is(err, client.ErrHandshakeFailed) {
+					t.Errorf("expected handshake failed error, got %v", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if c.Codec() != tt.expected {
+				t.Errorf("expected client codec %q, got %q", tt.expected, c.Codec())
+			}
+
+			var name string
+			err = c.Call(ctx, "Protocol", "Codec", nil, &name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if name != tt.expected {
+				t.Errorf("expected server codec %q, got %q", tt.expected, name)
+			}
+		})
+	}
+}
+
+func TestDeterministicCBOR(t *testing.T) {
+	data, err := codec.CborCodec{Deterministic: true}.Marshal(map[string]int{"b": 1, "c": 3, "a": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Map keys must be sorted
+	expected := []byte{0xa3, 0x61, 'a', 0x02, 0x61, 'b', 0x01, 0x61, 'c', 0x03}
+	if string(data) != string(expected) {
+		t.Errorf("expected %x, got %x", expected, data)
+	}
+}
+
+func TestClientChannelLeak(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create new network pipe
+	sConn, cConn := net.Pipe()
+
+	s := server.New()
+	defer s.Close()
+	// Register Upload for RPC
+	s.Register(Upload{})
+	// Serve the pipe connection using default codec
+	go s.ServeConn(ctx, sConn, codec.Default)
+
+	// Create new client using default codec
+	c := client.New(cConn, codec.Default)
+	defer c.Close()
+
+	start := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		// The channel is never closed, so the server has to
+		// stop receiving from it once the method returns
+		in := make(chan int, 1)
+		in <- i
+
+		var first int
+		err := c.Call(ctx, "Upload", "First", in, &first)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if first != i {
+			t.Errorf("expected %d, got %d", i, first)
+		}
+	}
+
+	// Wait for the goroutines of the calls to exit
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > start+10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected at most %d goroutines, got %d", start+10, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
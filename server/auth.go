@@ -0,0 +1,195 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"time"
+
+	"go.arsenm.dev/lrpc/errs"
+	"go.arsenm.dev/lrpc/internal/types"
+)
+
+// defaultAuthTimeout is how long clients have to be
+// authenticated if no auth timeout is set
+const defaultAuthTimeout = 10 * time.Second
+
+// Identity identifies an authenticated client
+type Identity struct {
+	// Name is the name of the client, such as a username
+	Name string
+	// Attrs contains additional information
+	// about the client, such as its role
+	Attrs map[string]string
+}
+
+// Authenticator authenticates clients when they connect,
+// before any of their calls are handled.
+//
+// The server reads the first bytes sent by the client to check
+// whether it's performing the handshake before authenticating it,
+// so unless the client performs the handshake or the server uses
+// WithoutHandshake, the client must send the first message.
+type Authenticator interface {
+	// Authenticate exchanges messages with the client using ex,
+	// and returns the client's identity if it's authenticated.
+	// If it returns an error, the client is rejected and its
+	// connection is closed.
+	Authenticate(ex *AuthExchange) (*Identity, error)
+}
+
+// AuthenticatorFunc is a function that implements Authenticator
+type AuthenticatorFunc func(ex *AuthExchange) (*Identity, error)
+
+func (fn AuthenticatorFunc) Authenticate(ex *AuthExchange) (*Identity, error) {
+	return fn(ex)
+}
+
+// AuthExchange is used by authenticators to exchange
+// messages with a client's credentials
+type AuthExchange struct {
+	conn *Conn
+}
+
+// Conn returns the connection being authenticated
+func (ex *AuthExchange) Conn() *Conn {
+	return ex.conn
+}
+
+// Send sends a message to the client
+func (ex *AuthExchange) Send(v any) error {
+	data, err := ex.conn.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return ex.conn.codec.Encode(types.Response{
+		Type:   types.ResponseTypeAuth,
+		Return: data,
+	})
+}
+
+// Recv receives a message from the client and decodes it into v,
+// which must be a pointer
+func (ex *AuthExchange) Recv(v any) error {
+	var req types.Request
+	err := ex.conn.codec.Decode(&req)
+	if err != nil {
+		return err
+	}
+
+	// Clients can't call anything before they're authenticated
+	if req.Type != types.RequestTypeAuth {
+		return ErrUnauthenticated
+	}
+
+	return ex.conn.codec.Unmarshal(req.Arg, v)
+}
+
+// authenticate authenticates the client on cn using the server's
+// authenticator, and tells the client whether it succeeded
+func (s *Server) authenticate(cn *Conn) error {
+	id, err := s.authenticator.Authenticate(&AuthExchange{conn: cn})
+	if err != nil {
+		// Don't tell the client why it was rejected,
+		// unless the authenticator gave a specific code
+		if errs.From(err).Code == errs.CodeUnknown {
+			err = ErrUnauthenticated
+		}
+
+		cn.codec.Encode(types.Response{
+			Type:  types.ResponseTypeError,
+			Error: encodeErr(cn.codec, err),
+		})
+		return err
+	}
+
+	cn.identity = id
+
+	return cn.codec.Encode(types.Response{
+		Type: types.ResponseTypeAuthDone,
+	})
+}
+
+// TokenAuthenticator returns an authenticator that receives a token
+// from the client, such as the one sent by client.TokenCredentials,
+// and passes it to validate, which returns the client's identity.
+func TokenAuthenticator(validate func(token string) (*Identity, error)) Authenticator {
+	return AuthenticatorFunc(func(ex *AuthExchange) (*Identity, error) {
+		var token string
+		err := ex.Recv(&token)
+		if err != nil {
+			return nil, err
+		}
+		return validate(token)
+	})
+}
+
+// HMACAuthenticator returns an authenticator that uses challenge-response
+// authentication with a key shared by the client and the server, such as
+// the one used by client.HMACCredentials. The client sends its ID, the
+// server sends back a random challenge, and the client proves that it
+// knows the key by sending the HMAC-SHA256 of the challenge.
+//
+// lookup returns the key of the client with the given ID. The name
+// of the client's identity is its ID.
+func HMACAuthenticator(lookup func(id string) ([]byte, error)) Authenticator {
+	return AuthenticatorFunc(func(ex *AuthExchange) (*Identity, error) {
+		var id string
+		err := ex.Recv(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := lookup(id)
+		if err != nil {
+			return nil, err
+		}
+
+		// Send a random challenge, so that the
+		// response can't be reused
+		challenge := make([]byte, 32)
+		_, err = rand.Read(challenge)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ex.Send(challenge)
+		if err != nil {
+			return nil, err
+		}
+
+		var mac []byte
+		err = ex.Recv(&mac)
+		if err != nil {
+			return nil, err
+		}
+
+		// Check that the client knows the key
+		h := hmac.New(sha256.New, key)
+		h.Write(challenge)
+		if !hmac.Equal(mac, h.Sum(nil)) {
+			return nil, ErrUnauthenticated
+		}
+
+		return &Identity{Name: id}, nil
+	})
+}
@@ -0,0 +1,115 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"sync"
+
+	"go.arsenm.dev/lrpc/internal/types"
+)
+
+// handleBatch executes every call in a batch and sends back
+// all of their responses in a single response.
+//
+// bCtx is the context of the whole batch, which must already
+// be stored in the connection's context map.
+func (s *Server) handleBatch(bCtx *Context, cn *Conn, call types.Request) {
+	defer s.endCall(cn)
+	defer s.closeIfOversized(cn)
+	defer bCtx.cancel()
+	c := cn.codec
+
+	res := make([]types.Response, len(call.Batch))
+	if call.Concurrent {
+		var wg sync.WaitGroup
+		for i, item := range call.Batch {
+			wg.Add(1)
+			go func(i int, item types.Request) {
+				defer wg.Done()
+				res[i] = s.executeBatchItem(bCtx, cn, call.Meta, item)
+			}(i, item)
+		}
+		wg.Wait()
+	} else {
+		for i, item := range call.Batch {
+			res[i] = s.executeBatchItem(bCtx, cn, call.Meta, item)
+		}
+	}
+
+	// The batch is over, so remove its context from the map
+	bCtx.contexts.delete(call.ID)
+
+	// Stop counting the batch towards the connection's
+	// limit before the client gets the response
+	s.releaseCall(cn, call)
+
+	// Encode response using codec
+	c.Encode(types.Response{
+		Type:  types.ResponseTypeBatch,
+		ID:    call.ID,
+		Batch: res,
+	})
+}
+
+// executeBatchItem executes a single call that's part of a batch,
+// and returns its response
+func (s *Server) executeBatchItem(bCtx *Context, cn *Conn, meta map[string]string, item types.Request) (res types.Response) {
+	c := cn.codec
+
+	// Create context for the call
+	ctx := newContext(bCtx, cn, item.Timeout, meta)
+	ctx.contexts = bCtx.contexts
+	ctx.batch = true
+	defer ctx.cancel()
+
+	// If the call panics, recover and return an error
+	// instead of crashing the server
+	defer func() {
+		if v := recover(); v != nil {
+			res = s.errResponse(c, ctx, item, nil, s.panicError(ctx, item, v))
+		}
+	}()
+
+	// Batches can only contain normal calls
+	if item.Type != types.RequestTypeNormal {
+		return s.errResponse(c, ctx, item, nil, ErrBatchChannel)
+	}
+
+	// Execute call
+	val, err := s.execute(
+		ctx,
+		item.Receiver,
+		item.Method,
+		item.Arg,
+	)
+	if err != nil {
+		return s.errResponse(c, ctx, item, val, err)
+	}
+
+	valData, err := c.Marshal(val)
+	if err != nil {
+		return s.errResponse(c, ctx, item, val, err)
+	}
+
+	return types.Response{
+		ID:     item.ID,
+		Return: valData,
+		Meta:   ctx.outgoingMetadata(),
+	}
+}
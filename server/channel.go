@@ -0,0 +1,175 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"reflect"
+	"sync"
+
+	"go.arsenm.dev/lrpc/internal/flow"
+	"go.arsenm.dev/lrpc/internal/types"
+)
+
+// inChannel receives values sent by the client
+// on a client-to-server channel
+type inChannel struct {
+	// ch receives the encoded values sent by the client.
+	// It is closed when the client closes its channel.
+	ch chan []byte
+	// eof is closed along with ch
+	eof chan struct{}
+	// done is closed when the context of the call
+	// that owns the channel is done
+	done chan struct{}
+	// granter grants credits to the client
+	// as values are consumed
+	granter *flow.Granter
+}
+
+// inChannels stores the client-to-server
+// channels of a connection by ID
+type inChannels struct {
+	mtx sync.Mutex
+	chs map[string]*inChannel
+}
+
+// add creates and stores a new channel with the given ID and window,
+// which is removed once ctx is done, and grants the client enough
+// credits to fill the window
+func (ic *inChannels) add(ctx *Context, id string, window int) *inChannel {
+	// grant grants n credits to the client
+	grant := func(n int) {
+		ctx.codec.Encode(types.Response{
+			Type:   types.ResponseTypeCredit,
+			ID:     id,
+			Window: n,
+		})
+	}
+
+	in := &inChannel{
+		ch:      make(chan []byte, window),
+		eof:     make(chan struct{}),
+		done:    make(chan struct{}),
+		granter: flow.NewGranter(window, grant),
+	}
+
+	ic.mtx.Lock()
+	ic.chs[id] = in
+	ic.mtx.Unlock()
+
+	grant(window)
+
+	go func() {
+		<-ctx.Done()
+		close(in.done)
+
+		ic.mtx.Lock()
+		delete(ic.chs, id)
+		ic.mtx.Unlock()
+	}()
+
+	return in
+}
+
+// send sends a value to the channel with the given ID,
+// discarding it if the channel does not exist. It never
+// blocks, as it's called by the connection's read loop.
+// Flow control ensures there is always room, so if there
+// isn't, ErrFlowControl is returned.
+func (ic *inChannels) send(id string, data []byte) error {
+	ic.mtx.Lock()
+	in, ok := ic.chs[id]
+	ic.mtx.Unlock()
+	if !ok {
+		return nil
+	}
+
+	select {
+	case in.ch <- data:
+	case <-in.done:
+	default:
+		return ErrFlowControl
+	}
+	return nil
+}
+
+// close closes and removes the channel with the given ID
+func (ic *inChannels) close(id string) {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+
+	in, ok := ic.chs[id]
+	if !ok {
+		return
+	}
+
+	close(in.ch)
+	close(in.eof)
+	delete(ic.chs, id)
+}
+
+// makeArgChannel creates a channel of type chType that receives
+// the values sent by the client on in, decoded using the context's
+// codec. It is closed when the client closes its channel or the
+// context is done.
+func makeArgChannel(ctx *Context, in *inChannel, chType reflect.Type) reflect.Value {
+	elemType := chType.Elem()
+	chVal := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, elemType), 0)
+	doneVal := reflect.ValueOf(in.done)
+
+	go func() {
+		defer chVal.Close()
+
+		for {
+			// Stop once the client closes its channel, or the context
+			// is done, as the client will never close its channel if
+			// the method returned or the connection was lost
+			var data []byte
+			select {
+			case d, ok := <-in.ch:
+				if !ok {
+					return
+				}
+				data = d
+			case <-in.done:
+				return
+			}
+
+			// Allow the client to send another value
+			in.granter.Consumed()
+
+			// Decode value into a new value of the element type
+			val := reflect.New(elemType)
+			err := ctx.codec.Unmarshal(data, val.Interface())
+			if err != nil {
+				continue
+			}
+
+			chosen, _, _ := reflect.Select([]reflect.SelectCase{
+				{Dir: reflect.SelectSend, Chan: chVal, Send: val.Elem()},
+				{Dir: reflect.SelectRecv, Chan: doneVal},
+			})
+			if chosen == 1 {
+				return
+			}
+		}
+	}()
+
+	return chVal.Convert(chType)
+}
@@ -0,0 +1,348 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.arsenm.dev/lrpc/internal/keepalive"
+	"go.arsenm.dev/lrpc/internal/limit"
+	"go.arsenm.dev/lrpc/internal/types"
+)
+
+// Transport is the way a connection is being served
+type Transport uint8
+
+const (
+	// TransportConn is used for connections served using ServeConn
+	TransportConn Transport = iota
+	// TransportListener is used for connections served using Serve
+	TransportListener
+	// TransportWebSocket is used for connections served using ServeWS
+	TransportWebSocket
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportConn:
+		return "conn"
+	case TransportListener:
+		return "listener"
+	case TransportWebSocket:
+		return "websocket"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnHook is called when a client connects or disconnects
+type ConnHook func(conn *Conn)
+
+// Conn is a connection being served by the server. It can be used
+// to store state that all calls made on the connection can access.
+type Conn struct {
+	rw    io.ReadWriter
+	codec *syncCodec
+
+	// codecName is chosen during the handshake,
+	// if the client performs it
+	codecName string
+
+	transport  Transport
+	remoteAddr net.Addr
+	identity   *Identity
+	tlsState   *tls.ConnectionState
+
+	valuesMtx sync.RWMutex
+	values    map[string]any
+
+	// activity records when the last message was received,
+	// including keepalive pings and pongs
+	activity *keepalive.Activity
+
+	// active is the amount of calls and channels in progress,
+	// and lastActive is the last time a request other than
+	// a keepalive ping or pong was received, or a call or
+	// channel finished
+	activeMtx  sync.Mutex
+	active     int
+	lastActive time.Time
+	// inFlight is the amount of calls in progress,
+	// not including open channels
+	inFlight int
+
+	// bucket limits how often an unauthenticated
+	// client can make calls
+	bucket *limit.Bucket
+
+	// oversizedArgs is the amount of arguments over
+	// the size limit that the client has sent
+	oversizedArgs int32
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// newConn creates a new connection using rw, served using the given
+// transport. remoteAddr may be nil if it's unknown. Its codec is
+// set once the server and the client have agreed on one.
+func newConn(rw io.ReadWriter, transport Transport, remoteAddr net.Addr) *Conn {
+	return &Conn{
+		rw: rw,
+		// Make sure only one message is encoded at a time
+		codec:      &syncCodec{},
+		transport:  transport,
+		remoteAddr: remoteAddr,
+		values:     map[string]any{},
+		activity:   keepalive.NewActivity(),
+		lastActive: time.Now(),
+		closed:     make(chan struct{}),
+	}
+}
+
+// Transport returns the transport used to serve the connection
+func (cn *Conn) Transport() Transport {
+	return cn.transport
+}
+
+// RemoteAddr returns the address of the client,
+// or nil if it's unknown
+func (cn *Conn) RemoteAddr() net.Addr {
+	return cn.remoteAddr
+}
+
+// Identity returns the identity of the client,
+// or nil if it wasn't authenticated
+func (cn *Conn) Identity() *Identity {
+	return cn.identity
+}
+
+// Get returns the value stored for the given key
+// and whether it exists
+func (cn *Conn) Get(key string) (any, bool) {
+	cn.valuesMtx.RLock()
+	defer cn.valuesMtx.RUnlock()
+	val, ok := cn.values[key]
+	return val, ok
+}
+
+// Set stores a value for the given key, which all
+// calls made on the connection can access
+func (cn *Conn) Set(key string, val any) {
+	cn.valuesMtx.Lock()
+	defer cn.valuesMtx.Unlock()
+	cn.values[key] = val
+}
+
+// Delete deletes the value stored for the given key
+func (cn *Conn) Delete(key string) {
+	cn.valuesMtx.Lock()
+	defer cn.valuesMtx.Unlock()
+	delete(cn.values, key)
+}
+
+// remoteAddr returns the remote address of rw,
+// or nil if it doesn't have one
+func remoteAddr(rw io.ReadWriter) net.Addr {
+	if ra, ok := rw.(interface{ RemoteAddr() net.Addr }); ok {
+		return ra.RemoteAddr()
+	}
+	return nil
+}
+
+// touch records that a request other than
+// a keepalive ping or pong was received
+func (cn *Conn) touch() {
+	cn.activeMtx.Lock()
+	cn.lastActive = time.Now()
+	cn.activeMtx.Unlock()
+}
+
+// begin records that a call or channel has started
+func (cn *Conn) begin() {
+	cn.activeMtx.Lock()
+	cn.active++
+	cn.activeMtx.Unlock()
+}
+
+// end records that a call or channel has finished
+func (cn *Conn) end() {
+	cn.activeMtx.Lock()
+	cn.active--
+	cn.lastActive = time.Now()
+	cn.activeMtx.Unlock()
+}
+
+// idleFor returns how long the connection has been idle,
+// or zero if there are calls or channels in progress
+func (cn *Conn) idleFor() time.Duration {
+	cn.activeMtx.Lock()
+	defer cn.activeMtx.Unlock()
+
+	if cn.active > 0 {
+		return 0
+	}
+	return time.Since(cn.lastActive)
+}
+
+// goAway tells the client that the server is going away
+func (cn *Conn) goAway() error {
+	return cn.codec.Encode(types.Response{
+		Type: types.ResponseTypeGoingAway,
+	})
+}
+
+// close closes the underlying connection, if it can be closed
+func (cn *Conn) close() {
+	cn.closeOnce.Do(func() {
+		close(cn.closed)
+		if closer, ok := cn.rw.(io.Closer); ok {
+			closer.Close()
+		}
+	})
+}
+
+// isClosed returns true if the connection was closed by the server
+func (cn *Conn) isClosed() bool {
+	select {
+	case <-cn.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// trackListener adds or removes a listener from the set of listeners
+// that will be closed on shutdown. It returns false if the listener
+// could not be added because the server is shutting down.
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if add {
+		if s.shuttingDown {
+			return false
+		}
+		s.listeners[ln] = struct{}{}
+	} else {
+		delete(s.listeners, ln)
+	}
+
+	return true
+}
+
+// trackHTTPServer adds or removes an HTTP server from the set of
+// HTTP servers that will be closed on shutdown. It returns false
+// if the server could not be added because the server is shutting down.
+func (s *Server) trackHTTPServer(srv *http.Server, add bool) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if add {
+		if s.shuttingDown {
+			return false
+		}
+		s.httpServers[srv] = struct{}{}
+	} else {
+		delete(s.httpServers, srv)
+	}
+
+	return true
+}
+
+// trackConn adds or removes a connection from the set of connections
+// that will be closed on shutdown. It returns false if the connection
+// could not be added because the server is shutting down.
+func (s *Server) trackConn(cn *Conn, add bool) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if add {
+		if s.shuttingDown {
+			return false
+		}
+		s.conns[cn] = struct{}{}
+	} else {
+		delete(s.conns, cn)
+	}
+
+	return true
+}
+
+// startCall registers a new in-progress call on cn. It
+// returns false if the server is shutting down, in which
+// case the call must not be started.
+func (s *Server) startCall(cn *Conn) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.shuttingDown {
+		return false
+	}
+	s.calls.Add(1)
+	cn.begin()
+
+	return true
+}
+
+// endCall records that a call or channel on cn has finished
+func (s *Server) endCall(cn *Conn) {
+	cn.end()
+	s.calls.Done()
+}
+
+// keepalive pings the client on cn regularly, and
+// closes cn if the client stops responding
+func (s *Server) keepalive(cn *Conn) {
+	ping := func() {
+		cn.codec.Encode(types.Response{Type: types.ResponseTypePing})
+	}
+
+	if keepalive.Run(cn.activity, s.keepaliveInterval, s.keepaliveTimeout, ping, cn.closed) {
+		cn.close()
+	}
+}
+
+// closeIdle closes cn once it has been idle for the idle timeout
+func (s *Server) closeIdle(cn *Conn) {
+	timer := time.NewTimer(s.idleTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-cn.closed:
+			return
+		}
+
+		// If the connection has been idle for long enough, close it.
+		// Otherwise, check again once it could have been.
+		idle := cn.idleFor()
+		if idle >= s.idleTimeout {
+			cn.close()
+			return
+		}
+		timer.Reset(s.idleTimeout - idle)
+	}
+}
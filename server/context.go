@@ -20,9 +20,12 @@ package server
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"go.arsenm.dev/lrpc/codec"
+	"go.arsenm.dev/lrpc/internal/flow"
+	"go.arsenm.dev/lrpc/internal/types"
 
 	"github.com/gofrs/uuid"
 )
@@ -33,27 +36,58 @@ type Context struct {
 	channelID string
 	channel   chan any
 
+	// window is the buffer size of channels created by MakeChannel
+	window int
+	// clientWindow is the amount of values the client can
+	// buffer for a channel, or zero if it doesn't use flow control
+	clientWindow int
+	// sendWindow keeps track of the credits granted by the client
+	// for the channel, if it uses flow control
+	sendWindow *flow.Window
+
+	// reqType is the type of the request
+	// that created this context
+	reqType types.RequestType
+	// notify is true if the client
+	// doesn't want a response
+	notify bool
+	// batch is true if the call is
+	// part of a batch
+	batch bool
+
+	// in receives values from the client if the argument
+	// of the call is a channel, or if it's a stream
+	in *inChannel
+
 	codec codec.Codec
+	conn  *Conn
+	// contexts is the context map of the
+	// connection that the call was made on
+	contexts *contextMap
 
-	doneCh   chan struct{}
-	canceled bool
+	metaMtx sync.Mutex
+	inMeta  map[string]string
+	outMeta map[string]string
 
-	ctx context.Context
+	ctx      context.Context
+	cancelFn context.CancelFunc
 }
 
-func newContext(ctx context.Context, codec codec.Codec) *Context {
-	out := &Context{
-		doneCh: make(chan struct{}),
-		codec:  codec,
-		ctx:    ctx,
-	}
+// newContext creates a new context for a call made on cn, derived
+// from ctx. If timeout is greater than zero, the context will expire
+// once it elapses. meta is the metadata sent by the client.
+func newContext(ctx context.Context, cn *Conn, timeout time.Duration, meta map[string]string) *Context {
 	if ctx == nil {
-		out.ctx = context.Background()
+		ctx = context.Background()
 	}
-	go func() {
-		<-out.ctx.Done()
-		out.cancel()
-	}()
+
+	out := &Context{codec: cn.codec, conn: cn, inMeta: meta}
+	if timeout > 0 {
+		out.ctx, out.cancelFn = context.WithTimeout(ctx, timeout)
+	} else {
+		out.ctx, out.cancelFn = context.WithCancel(ctx)
+	}
+
 	return out
 }
 
@@ -64,51 +98,239 @@ func newContext(ctx context.Context, codec codec.Codec) *Context {
 // This will ovewrite any return value of the function with
 // a channel ID.
 func (ctx *Context) MakeChannel() (chan<- any, error) {
+	return ctx.MakeChannelWindow(ctx.window)
+}
+
+// MakeChannelWindow is like MakeChannel, but allows setting the
+// window of the channel, which is the amount of values that can
+// be buffered by the server before sending blocks. Each channel
+// has its own window, so a slow client only blocks the channels
+// it's consuming slowly. A window of 0 makes sending block until
+// the value is sent to the client, and negative windows are invalid.
+func (ctx *Context) MakeChannelWindow(window int) (chan<- any, error) {
+	if window < 0 {
+		return nil, ErrInvalidWindow
+	}
+
+	// The client won't receive the channel ID of a notification
+	if ctx.notify {
+		return nil, ErrNotifyChannel
+	}
+
+	// Batches only send back one response for each call
+	if ctx.batch {
+		return nil, ErrBatchChannel
+	}
+
 	ctx.isChannel = true
 	chID, err := uuid.NewV4()
 	ctx.channelID = chID.String()
-	ctx.channel = make(chan any, 5)
+	ctx.channel = make(chan any, window)
+
+	// If the client uses flow control, only allow as many
+	// values as it can buffer to be sent at a time
+	if ctx.clientWindow > 0 {
+		ctx.sendWindow = flow.NewWindow(ctx.clientWindow)
+	}
+
 	return ctx.channel, err
 }
 
+// MakeStream changes the function it's called in into a stream
+// function, and returns a bidirectional stream that can be used
+// to exchange values with the client. It can only be called in
+// methods called using client.Stream.
+//
+// This will ovewrite any return value of the function.
+func (ctx *Context) MakeStream() (*Stream, error) {
+	if ctx.reqType != types.RequestTypeStream {
+		return nil, ErrNotStream
+	}
+
+	_, err := ctx.MakeChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	return newStream(ctx), nil
+}
+
+// IsNotification returns true if the call was sent using
+// client.Notify, in which case the client will not receive
+// any return value or error
+func (ctx *Context) IsNotification() bool {
+	return ctx.notify
+}
+
+// IsChannel returns true if MakeChannel has been
+// called on this context
+func (ctx *Context) IsChannel() bool {
+	return ctx.isChannel
+}
+
+// Metadata returns the metadata sent by the client
+// along with the call. It should not be modified.
+func (ctx *Context) Metadata() map[string]string {
+	return ctx.inMeta
+}
+
+// GetMetadata returns the value of the given key in
+// the metadata sent by the client
+func (ctx *Context) GetMetadata(key string) string {
+	return ctx.inMeta[key]
+}
+
+// SetMetadata sets a key in the metadata that will be
+// sent back to the client with the response
+func (ctx *Context) SetMetadata(key, value string) {
+	ctx.metaMtx.Lock()
+	defer ctx.metaMtx.Unlock()
+
+	if ctx.outMeta == nil {
+		ctx.outMeta = map[string]string{}
+	}
+	ctx.outMeta[key] = value
+}
+
+// outgoingMetadata returns a copy of the metadata
+// that will be sent back to the client
+func (ctx *Context) outgoingMetadata() map[string]string {
+	ctx.metaMtx.Lock()
+	defer ctx.metaMtx.Unlock()
+
+	if ctx.outMeta == nil {
+		return nil
+	}
+
+	out := make(map[string]string, len(ctx.outMeta))
+	for k, v := range ctx.outMeta {
+		out[k] = v
+	}
+	return out
+}
+
+// Conn returns the connection that the call was made on
+func (ctx *Context) Conn() *Conn {
+	return ctx.conn
+}
+
+// Identity returns the identity of the client that made the
+// call, or nil if the server doesn't authenticate clients
+func (ctx *Context) Identity() *Identity {
+	return ctx.conn.identity
+}
+
 // GetCodec returns a codec bound to the connection
 // that called this function
 func (ctx *Context) GetCodec() codec.Codec {
 	return ctx.codec
 }
 
-// Deadline always returns the current time and false
-// as this context does not support deadlines
-func (ctx *Context) Deadline() (time.Time, bool) {
-	return time.Now(), false
+// Deadline returns the time when the context will expire, which
+// is set by the client using the deadline of its context. If no
+// deadline is set, ok is false.
+func (ctx *Context) Deadline() (deadline time.Time, ok bool) {
+	return ctx.ctx.Deadline()
 }
 
-// Value always returns nil as this context stores no values
+// Value returns the value associated with key in the
+// context the server was started with
 func (ctx *Context) Value(key any) any {
 	return ctx.ctx.Value(key)
 }
 
 // Err returns context.Canceled if the context was canceled,
-// otherwise nil
+// context.DeadlineExceeded if its deadline passed, or nil
+// if the context is still active.
 func (ctx *Context) Err() error {
-	if ctx.canceled {
-		return context.Canceled
-	}
-	return nil
+	return ctx.ctx.Err()
 }
 
 // Done returns a channel that will be closed when
 // the context is canceled, such as when ChannelDone
-// is called by the client
+// is called by the client, or when its deadline passes
 func (ctx *Context) Done() <-chan struct{} {
-	return ctx.doneCh
+	return ctx.ctx.Done()
 }
 
-// Cancel cancels the context
+// cancel cancels the context
 func (ctx *Context) cancel() {
-	if ctx.canceled {
+	ctx.cancelFn()
+}
+
+// contextMap contains the contexts of the calls and channels in
+// progress on a connection, keyed by their IDs. Since call IDs are
+// chosen by the client, every connection has its own map, so that
+// clients can only cancel their own calls.
+type contextMap struct {
+	mtx  sync.Mutex
+	ctxs map[string]*Context
+}
+
+// newContextMap creates a context map for a new connection,
+// whose contexts will be canceled when the server is closed
+func (s *Server) newContextMap() *contextMap {
+	ctxs := &contextMap{ctxs: map[string]*Context{}}
+	s.contextsMtx.Lock()
+	s.contexts[ctxs] = struct{}{}
+	s.contextsMtx.Unlock()
+	return ctxs
+}
+
+// deleteContextMap removes the context map of a
+// connection once the connection has ended
+func (s *Server) deleteContextMap(ctxs *contextMap) {
+	s.contextsMtx.Lock()
+	delete(s.contexts, ctxs)
+	s.contextsMtx.Unlock()
+}
+
+// store adds a context to the map
+func (cm *contextMap) store(id string, ctx *Context) {
+	cm.mtx.Lock()
+	defer cm.mtx.Unlock()
+	cm.ctxs[id] = ctx
+}
+
+// get returns the context with the given ID
+func (cm *contextMap) get(id string) (*Context, bool) {
+	cm.mtx.Lock()
+	defer cm.mtx.Unlock()
+	ctx, ok := cm.ctxs[id]
+	return ctx, ok
+}
+
+// delete removes a context from the map
+func (cm *contextMap) delete(id string) {
+	cm.mtx.Lock()
+	defer cm.mtx.Unlock()
+	delete(cm.ctxs, id)
+}
+
+// cancel cancels the context with the given ID
+// and removes it from the map
+func (cm *contextMap) cancel(id string) {
+	cm.mtx.Lock()
+	defer cm.mtx.Unlock()
+
+	// Try to get context
+	ctx, ok := cm.ctxs[id]
+	if !ok {
 		return
 	}
-	ctx.canceled = true
-	close(ctx.doneCh)
+
+	// Cancel context
+	ctx.cancel()
+	// Delete context from map
+	delete(cm.ctxs, id)
+}
+
+// cancelAll cancels every context in the map
+func (cm *contextMap) cancelAll() {
+	cm.mtx.Lock()
+	defer cm.mtx.Unlock()
+
+	for _, ctx := range cm.ctxs {
+		ctx.cancel()
+	}
 }
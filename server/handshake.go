@@ -0,0 +1,112 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"io"
+
+	"go.arsenm.dev/lrpc/codec"
+	"go.arsenm.dev/lrpc/internal/handshake"
+)
+
+// errNoCodec is returned when trying to send
+// a message before a codec has been chosen
+var errNoCodec = errors.New("no codec has been chosen yet")
+
+// Codec returns the name of the codec chosen during the
+// handshake, or an empty string if the client didn't
+// perform the handshake
+func (cn *Conn) Codec() string {
+	return cn.codecName
+}
+
+// negotiate performs the handshake with the client if it starts
+// one, and sets the codec of cn to the chosen codec. Otherwise,
+// it uses cf, so that clients that don't perform the handshake
+// can still connect.
+func (s *Server) negotiate(cn *Conn, cf codec.CodecFunc) error {
+	// Checking for the handshake blocks until the client
+	// sends something, so skip it if it's disabled
+	if s.noHandshake {
+		cn.codec.setCodec(s.codecFunc(cf)(cn.rw))
+		return nil
+	}
+
+	r, ok, err := handshake.Detect(cn.rw)
+	if err != nil {
+		return err
+	}
+
+	// Codecs must read the bytes that were read to detect the handshake
+	rw := readWriter{Reader: r, Writer: cn.rw}
+
+	if ok {
+		var hello handshake.Hello
+		err = handshake.Read(rw, &hello)
+		if err != nil {
+			return err
+		}
+
+		reply, err := handshake.Choose(hello, s.supportsCodec)
+		if err != nil {
+			// Tell the client why the handshake failed
+			handshake.Write(rw, handshake.Reply{Error: err.Error()})
+			return err
+		}
+
+		err = handshake.Write(rw, reply)
+		if err != nil {
+			return err
+		}
+
+		cf, _ = codec.Get(reply.Codec)
+		cn.codecName = reply.Codec
+	}
+
+	cn.codec.setCodec(s.codecFunc(cf)(rw))
+	return nil
+}
+
+// supportsCodec returns true if the server can use the codec with
+// the given name. If the server has a list of codecs, only codecs in
+// it are supported. Otherwise, all registered codecs are supported.
+func (s *Server) supportsCodec(name string) bool {
+	if _, ok := codec.Get(name); !ok {
+		return false
+	}
+
+	if s.codecs == nil {
+		return true
+	}
+
+	for _, c := range s.codecs {
+		if c == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readWriter combines a separate reader and writer
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
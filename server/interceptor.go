@@ -0,0 +1,38 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+// Handler handles a call with the given context and argument
+type Handler func(ctx *Context, arg any) (any, error)
+
+// Interceptor wraps every call dispatched by the server. It receives
+// the names of the receiver and method being called, the decoded
+// argument, and the next handler in the chain. An interceptor may
+// return early without calling next, or modify the argument passed
+// to next and the values it returns.
+//
+// For methods that call MakeChannel, the returned value is discarded,
+// and ctx.IsChannel() will return true once next has returned.
+type Interceptor func(ctx *Context, rcvr, method string, arg any, next Handler) (any, error)
+
+// Use adds interceptors to the server. Interceptors are run in the
+// order they were added, so the first one added is the outermost.
+func (s *Server) Use(interceptors ...Interceptor) {
+	s.interceptors = append(s.interceptors, interceptors...)
+}
@@ -0,0 +1,153 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"sync/atomic"
+
+	"go.arsenm.dev/lrpc/codec"
+	"go.arsenm.dev/lrpc/internal/limit"
+	"go.arsenm.dev/lrpc/internal/types"
+)
+
+// admit checks whether a call received on cn is within the
+// connection's concurrency limit and the client's rate limit.
+// If it is, releaseCall must be called once the call is over.
+func (s *Server) admit(cn *Conn, call types.Request) error {
+	// Every call in a batch counts towards the rate limit
+	n := 1
+	if call.Type == types.RequestTypeBatch {
+		n = len(call.Batch)
+	}
+
+	if !s.allowClient(cn, n) {
+		return ErrResourceExhausted
+	}
+
+	cn.activeMtx.Lock()
+	defer cn.activeMtx.Unlock()
+
+	calls := concurrentCalls(call)
+	if s.maxCalls > 0 && cn.inFlight+calls > s.maxCalls {
+		return ErrResourceExhausted
+	}
+	cn.inFlight += calls
+
+	return nil
+}
+
+// releaseCall records that a call admitted on cn is over
+func (s *Server) releaseCall(cn *Conn, call types.Request) {
+	cn.activeMtx.Lock()
+	cn.inFlight -= concurrentCalls(call)
+	cn.activeMtx.Unlock()
+}
+
+// concurrentCalls returns the amount of calls that run at once
+// for the given request. The calls in a concurrent batch all run
+// at once, so each of them counts towards the concurrency limit.
+func concurrentCalls(call types.Request) int {
+	if call.Type == types.RequestTypeBatch && call.Concurrent {
+		return len(call.Batch)
+	}
+	return 1
+}
+
+// allowClient takes n tokens from the bucket of the client on cn.
+// Authenticated clients share a bucket across all their connections,
+// while other clients get one bucket per connection.
+func (s *Server) allowClient(cn *Conn, n int) bool {
+	if s.clientLimits == nil {
+		return true
+	}
+
+	if cn.identity != nil {
+		return s.clientLimits.Allow(cn.identity.Name, n)
+	}
+
+	return cn.bucket.Allow(n)
+}
+
+// allowMethod takes a token from the buckets of the given
+// method and of its receiver, if they have rate limits
+func (s *Server) allowMethod(rcvr, method string) bool {
+	for _, key := range []string{policyKey(rcvr, ""), policyKey(rcvr, method)} {
+		if b, ok := s.methodLimits[key]; ok && !b.Allow(1) {
+			return false
+		}
+	}
+	return true
+}
+
+// acquireWorker waits for one of the server's workers to be free,
+// if the amount of workers is limited. The returned function must
+// be called to free the worker once the call is over.
+func (s *Server) acquireWorker(ctx *Context, rcvr, method string) (func(), error) {
+	// Calls that close channels or cancel calls don't
+	// need a worker, so that they're never delayed
+	if s.workers == nil || isControlCall(rcvr, method) {
+		return func() {}, nil
+	}
+
+	select {
+	case s.workers <- struct{}{}:
+		return func() { <-s.workers }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// newMethodLimit creates a rate limit for the given method
+// of the given receiver, or all its methods if method is empty
+func (s *Server) newMethodLimit(rcvr, method string, rate float64, burst int) {
+	if s.methodLimits == nil {
+		s.methodLimits = map[string]*limit.Bucket{}
+	}
+	s.methodLimits[policyKey(rcvr, method)] = limit.NewBucket(rate, burst)
+}
+
+// maxOversized is the amount of arguments over the size
+// limit a client can send before its connection is closed
+const maxOversized = 3
+
+// codecFunc returns a CodecFunc that creates codecs using cf,
+// which enforce the server's message size limit, if it has one
+func (s *Server) codecFunc(cf codec.CodecFunc) codec.CodecFunc {
+	if s.maxMessageSize > 0 {
+		return codec.Limit(cf, s.maxMessageSize)
+	}
+	return cf
+}
+
+// oversized records that the client sent an
+// argument over the size limit
+func (cn *Conn) oversized() {
+	atomic.AddInt32(&cn.oversizedArgs, 1)
+}
+
+// closeIfOversized closes cn if the client has sent too many
+// arguments over the size limit, after telling the client why
+func (s *Server) closeIfOversized(cn *Conn) {
+	if atomic.LoadInt32(&cn.oversizedArgs) < maxOversized {
+		return
+	}
+
+	s.sendErr(cn.codec, nil, types.Request{}, nil, ErrMessageTooLarge)
+	cn.close()
+}
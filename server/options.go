@@ -0,0 +1,221 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"time"
+
+	"go.arsenm.dev/lrpc/internal/limit"
+)
+
+// Option configures a server
+type Option func(*Server)
+
+// PanicHandler is called when a method panics, with the
+// context and names of the call that caused the panic
+type PanicHandler func(ctx *Context, rcvr, method string, err *PanicError)
+
+// WithPanicHandler sets a function that will be called
+// whenever a method panics
+func WithPanicHandler(h PanicHandler) Option {
+	return func(s *Server) {
+		s.panicHandler = h
+	}
+}
+
+// WithDebug enables debug mode, in which the stack traces
+// of panics are sent to the client along with the error
+func WithDebug() Option {
+	return func(s *Server) {
+		s.debug = true
+	}
+}
+
+// WithChannelWindow sets the default window of channels, which is
+// the amount of values that can be buffered by the server for each
+// channel. For channels created using MakeChannel, this is how many
+// values can be sent before blocking. For channels sent by the client,
+// this is how many values the client can send before it has to wait
+// for the method to receive them. The window must be at least 1,
+// so smaller values are treated as 1.
+func WithChannelWindow(window int) Option {
+	return func(s *Server) {
+		if window < 1 {
+			window = 1
+		}
+		s.channelWindow = window
+	}
+}
+
+// WithKeepalive makes the server ping clients every interval.
+// If a client doesn't send anything back within timeout of a
+// ping, its connection is closed, and the contexts of its calls
+// are canceled.
+func WithKeepalive(interval, timeout time.Duration) Option {
+	return func(s *Server) {
+		s.keepaliveInterval = interval
+		s.keepaliveTimeout = timeout
+	}
+}
+
+// WithIdleTimeout makes the server close connections that have
+// been idle for the given duration. A connection is idle if it
+// has no calls or channels in progress and the client hasn't
+// sent anything other than keepalive pings.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// WithAuthenticator makes the server authenticate clients using the
+// given Authenticator when they connect. Clients that fail
+// authentication, or that aren't authenticated within the auth
+// timeout, are disconnected before any of their calls are handled.
+func WithAuthenticator(a Authenticator) Option {
+	return func(s *Server) {
+		s.authenticator = a
+	}
+}
+
+// WithAuthTimeout sets how long clients have to be authenticated
+// after they connect, including the TLS handshake and the handshake
+// in which the codec is chosen. Clients that take longer are
+// disconnected. The default is 10 seconds, and zero disables it.
+// It only applies if the server has an authenticator.
+func WithAuthTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.authTimeout = d
+	}
+}
+
+// WithPolicy sets a policy that applies to every call. Calls that
+// aren't allowed by the policy, or by the policy of the method's
+// receiver or the method itself, fail with ErrPermissionDenied
+// before the method is called.
+func WithPolicy(p Policy) Option {
+	return func(s *Server) {
+		s.policy = p
+	}
+}
+
+// WithTLSConfig makes Serve and ServeWS serve clients using TLS with
+// the given config. To require clients to use mutual TLS, set
+// cfg.ClientAuth to tls.RequireAndVerifyClientCert. The verified
+// certificate of a client is available using Context.PeerCertificate.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = cfg
+	}
+}
+
+// WithMaxConcurrentCalls limits the amount of calls each connection
+// can have in progress at once. Calls made while the limit is reached
+// fail with ErrResourceExhausted. A batch whose calls run one at a
+// time counts as a single call, while every call in a concurrent
+// batch counts separately, so concurrent batches with more calls
+// than the limit are always rejected.
+func WithMaxConcurrentCalls(n int) Option {
+	return func(s *Server) {
+		s.maxCalls = n
+	}
+}
+
+// WithWorkers limits the amount of methods that can run at once
+// across all connections. Calls wait for a worker to be free, until
+// their context is canceled. Methods that create channels or streams
+// only use a worker until they return. If n is less than 1, the
+// amount of methods that can run at once isn't limited.
+func WithWorkers(n int) Option {
+	return func(s *Server) {
+		if n < 1 {
+			s.workers = nil
+			return
+		}
+		s.workers = make(chan struct{}, n)
+	}
+}
+
+// WithMethodRateLimit limits how often the given method of the given
+// receiver, or every method of the receiver if method is empty, can be
+// called by all clients combined. Calls are allowed at rate calls per
+// second, with bursts of up to burst calls. Calls over the limit fail
+// with ErrResourceExhausted.
+func WithMethodRateLimit(rcvr, method string, rate float64, burst int) Option {
+	return func(s *Server) {
+		s.newMethodLimit(rcvr, method, rate, burst)
+	}
+}
+
+// WithClientRateLimit limits how often each client can make calls, at
+// rate calls per second with bursts of up to burst calls. Authenticated
+// clients are limited by the name of their identity, across all of their
+// connections, and other clients are limited per connection. Every call
+// in a batch counts towards the limit. Calls over the limit fail with
+// ErrResourceExhausted.
+func WithClientRateLimit(rate float64, burst int) Option {
+	return func(s *Server) {
+		s.clientLimits = limit.NewBuckets(rate, burst)
+	}
+}
+
+// WithMaxMessageSize limits the size of messages sent by clients to
+// n bytes. Messages are checked while they're being read, so larger
+// ones are never read into memory. If a client sends a larger message,
+// it gets an ErrMessageTooLarge error and its connection is closed,
+// as the rest of the message can't be skipped. The limit is
+// approximate, as codecs may read ahead of the current message.
+// It doesn't apply to framed codecs, which enforce their own limit.
+func WithMaxMessageSize(n int64) Option {
+	return func(s *Server) {
+		s.maxMessageSize = n
+	}
+}
+
+// WithMaxArgSize limits the size of encoded arguments to n bytes.
+// Calls with larger arguments fail with ErrMessageTooLarge before
+// the arguments are decoded. If a client keeps sending arguments
+// that are too large, its connection is closed.
+func WithMaxArgSize(n int) Option {
+	return func(s *Server) {
+		s.maxArgSize = n
+	}
+}
+
+// WithCodecs sets the names of the codecs that clients can choose
+// during the handshake. By default, clients can choose any codec
+// registered using codec.Register. Clients that don't perform the
+// handshake use the codec passed to Serve, ServeWS, or ServeConn.
+func WithCodecs(names ...string) Option {
+	return func(s *Server) {
+		s.codecs = names
+	}
+}
+
+// WithoutHandshake disables the handshake, so every client is served
+// using the codec passed to Serve, ServeWS, or ServeConn. Normally,
+// the server waits for the first bytes sent by the client to check
+// whether it's performing the handshake, so this is needed if clients
+// don't perform it and the authenticator sends the first message.
+func WithoutHandshake() Option {
+	return func(s *Server) {
+		s.noHandshake = true
+	}
+}
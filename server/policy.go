@@ -0,0 +1,113 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+// Policy decides whether a call to the given receiver and method
+// is allowed. ctx can be used to get the caller's identity.
+type Policy func(ctx *Context, rcvr, method string) bool
+
+// RegisterOption configures a receiver when it's registered
+type RegisterOption func(s *Server, name string)
+
+// ReceiverPolicy sets a policy that applies
+// to every method of the receiver
+func ReceiverPolicy(p Policy) RegisterOption {
+	return func(s *Server, name string) {
+		s.SetPolicy(name, "", p)
+	}
+}
+
+// MethodPolicy sets a policy that applies to
+// the given method of the receiver
+func MethodPolicy(method string, p Policy) RegisterOption {
+	return func(s *Server, name string) {
+		s.SetPolicy(name, method, p)
+	}
+}
+
+// SetPolicy sets a policy that applies to the given method of the
+// given receiver, or every method of the receiver if method is empty.
+// This can also be used to restrict the built-in methods of the "lrpc"
+// receiver, such as lrpc.IntrospectAll.
+func (s *Server) SetPolicy(rcvr, method string, p Policy) {
+	s.policies[policyKey(rcvr, method)] = p
+}
+
+// authorize checks whether the call is allowed by the global
+// policy, the receiver's policy, and the method's policy
+func (s *Server) authorize(ctx *Context, rcvr, method string) error {
+	// Calls that close channels or cancel calls only
+	// affect the caller's own calls, so they're always allowed
+	if isControlCall(rcvr, method) {
+		return nil
+	}
+
+	policies := []Policy{
+		s.policy,
+		s.policies[policyKey(rcvr, "")],
+		s.policies[policyKey(rcvr, method)],
+	}
+
+	for _, p := range policies {
+		if p != nil && !p(ctx, rcvr, method) {
+			return ErrPermissionDenied
+		}
+	}
+
+	return nil
+}
+
+// policyKey returns the key of the policy for
+// the given receiver and method in the policy map
+func policyKey(rcvr, method string) string {
+	return rcvr + "." + method
+}
+
+// RequireIdentity returns a policy that only
+// allows calls from authenticated clients
+func RequireIdentity() Policy {
+	return func(ctx *Context, _, _ string) bool {
+		return ctx.Identity() != nil
+	}
+}
+
+// RequireAttr returns a policy that only allows calls from
+// authenticated clients whose identity has the given attribute
+// set to one of the given values
+func RequireAttr(key string, values ...string) Policy {
+	return func(ctx *Context, _, _ string) bool {
+		id := ctx.Identity()
+		if id == nil {
+			return false
+		}
+
+		attr, ok := id.Attrs[key]
+		if !ok {
+			return false
+		}
+
+		for _, val := range values {
+			if attr == val {
+				return true
+			}
+		}
+
+		return false
+	}
+}
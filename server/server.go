@@ -20,14 +20,21 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"reflect"
+	"runtime/debug"
 	"sync"
+	"time"
 
 	"go.arsenm.dev/lrpc/codec"
+	"go.arsenm.dev/lrpc/errs"
+	"go.arsenm.dev/lrpc/internal/flow"
+	"go.arsenm.dev/lrpc/internal/limit"
 	"go.arsenm.dev/lrpc/internal/types"
 	"golang.org/x/net/websocket"
 )
@@ -37,26 +44,114 @@ type any = interface{}
 
 var (
 	ErrInvalidType    = errors.New("type must be struct or pointer to struct")
-	ErrNoSuchReceiver = errors.New("no such receiver registered")
-	ErrNoSuchMethod   = errors.New("no such method was found")
-	ErrInvalidMethod  = errors.New("method invalid for lrpc call")
-	ErrArgNotProvided = errors.New("method expected an argument, but none was provided")
+	ErrInvalidWindow  = errors.New("channel window must not be negative")
+	ErrNoSuchReceiver = errs.New(errs.CodeNoSuchReceiver, "no such receiver registered")
+	ErrNoSuchMethod   = errs.New(errs.CodeNoSuchMethod, "no such method was found")
+	ErrInvalidMethod  = errs.New(errs.CodeInvalidMethod, "method invalid for lrpc call")
+	ErrArgNotProvided = errs.New(errs.CodeArgNotProvided, "method expected an argument, but none was provided")
+	ErrPanic          = errs.New(errs.CodePanic, "method panicked")
+
+	ErrArgNotChannel     = errs.New(errs.CodeArgNotChannel, "method expected a channel argument, but the argument is not a channel")
+	ErrUnexpectedChannel = errs.New(errs.CodeUnexpectedChannel, "argument is a channel, but method does not accept a channel")
+	ErrNotStream         = errs.New(errs.CodeNotStream, "streams can only be created in calls made using client.Stream")
+	ErrShuttingDown      = errs.New(errs.CodeUnavailable, "server is shutting down")
+	ErrNotifyChannel     = errs.New(errs.CodeNotifyChannel, "channels cannot be created in notifications")
+	ErrBatchChannel      = errs.New(errs.CodeBatchChannel, "channels and streams cannot be used in batches")
+	ErrUnauthenticated   = errs.New(errs.CodeUnauthenticated, "authentication failed")
+	ErrPermissionDenied  = errs.New(errs.CodePermissionDenied, "permission denied")
+	ErrResourceExhausted = errs.New(errs.CodeResourceExhausted, "resource limit exceeded")
+	ErrMessageTooLarge   = errs.New(errs.CodeMessageTooLarge, "message too large")
+	ErrFlowControl       = errs.New(errs.CodeFlowControl, "client sent more values than the channel's window allows")
 )
 
+// PanicError is returned to the client when a method panics.
+// It wraps ErrPanic.
+type PanicError struct {
+	// Value is the value passed to panic
+	Value any
+	// Stack is the stack trace of the goroutine that panicked.
+	// It is only sent to the client in debug mode.
+	Stack []byte
+}
+
+func (pe *PanicError) Error() string {
+	if pe.Stack != nil {
+		return fmt.Sprintf("%s: %v\n%s", ErrPanic, pe.Value, pe.Stack)
+	}
+	return fmt.Sprintf("%s: %v", ErrPanic, pe.Value)
+}
+
+func (pe *PanicError) Unwrap() error {
+	return ErrPanic
+}
+
 // Server is an lrpc server
 type Server struct {
 	rcvrs map[string]reflect.Value
 
+	interceptors []Interceptor
+
+	onConnect    []ConnHook
+	onDisconnect []ConnHook
+
+	authenticator Authenticator
+	authTimeout   time.Duration
+	tlsConfig     *tls.Config
+
+	policy   Policy
+	policies map[string]Policy
+
+	maxCalls     int
+	workers      chan struct{}
+	methodLimits map[string]*limit.Bucket
+	clientLimits *limit.Buckets
+
+	maxMessageSize int64
+	maxArgSize     int
+
+	codecs []string
+	// noHandshake disables the handshake
+	noHandshake bool
+
+	// contexts contains the context map of every connection
 	contextsMtx sync.Mutex
-	contexts    map[string]*Context
+	contexts    map[*contextMap]struct{}
+
+	panicHandler PanicHandler
+	debug        bool
+
+	channelWindow int
+
+	mtx          sync.Mutex
+	shuttingDown bool
+	listeners    map[net.Listener]struct{}
+	httpServers  map[*http.Server]struct{}
+	conns        map[*Conn]struct{}
+	// calls tracks in-progress calls and open channels
+	calls sync.WaitGroup
+
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+	idleTimeout       time.Duration
 }
 
 // New creates and returns a new server
-func New() *Server {
+func New(opts ...Option) *Server {
 	// Create new server
 	out := &Server{
-		rcvrs:    map[string]reflect.Value{},
-		contexts: map[string]*Context{},
+		rcvrs:         map[string]reflect.Value{},
+		policies:      map[string]Policy{},
+		contexts:      map[*contextMap]struct{}{},
+		channelWindow: flow.DefaultWindow,
+		authTimeout:   defaultAuthTimeout,
+		listeners:     map[net.Listener]struct{}{},
+		httpServers:   map[*http.Server]struct{}{},
+		conns:         map[*Conn]struct{}{},
+	}
+
+	// Apply all provided options
+	for _, opt := range opts {
+		opt(out)
 	}
 
 	// Register lrpc functions
@@ -65,15 +160,75 @@ func New() *Server {
 	return out
 }
 
-// Close closes the server
+// Close closes the server, canceling all in-progress
+// calls and channels. Use Shutdown to wait for them to
+// finish instead.
 func (s *Server) Close() {
-	for _, ctx := range s.contexts {
-		ctx.cancel()
+	s.contextsMtx.Lock()
+	defer s.contextsMtx.Unlock()
+
+	for ctxs := range s.contexts {
+		ctxs.cancelAll()
 	}
 }
 
+// Shutdown gracefully shuts down the server. It stops accepting
+// new connections and calls, tells connected clients that the
+// server is going away, waits for in-progress calls and channels
+// to finish, and then closes all connections.
+//
+// If ctx is done before all calls and channels are finished,
+// they are canceled, all connections are closed, and the
+// context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mtx.Lock()
+	s.shuttingDown = true
+	// Stop accepting new connections
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for srv := range s.httpServers {
+		srv.Close()
+	}
+	// Tell all clients that the server is going away
+	var sent sync.WaitGroup
+	for cn := range s.conns {
+		sent.Add(1)
+		go func(cn *Conn) {
+			defer sent.Done()
+			cn.goAway()
+		}(cn)
+	}
+	s.mtx.Unlock()
+
+	// Wait for all calls and channels to finish
+	done := make(chan struct{})
+	go func() {
+		sent.Wait()
+		s.calls.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.Close()
+		err = ctx.Err()
+	}
+
+	// Close all connections
+	s.mtx.Lock()
+	for cn := range s.conns {
+		cn.close()
+	}
+	s.mtx.Unlock()
+
+	return err
+}
+
 // Register registers a value to be called by a client
-func (s *Server) Register(v any) error {
+func (s *Server) Register(v any, opts ...RegisterOption) error {
 	// Get reflect values for v
 	val := reflect.ValueOf(v)
 	kind := val.Kind()
@@ -95,26 +250,48 @@ func (s *Server) Register(v any) error {
 	// Add v to receivers map
 	s.rcvrs[name] = val
 
+	// Apply all provided options
+	for _, opt := range opts {
+		opt(s, name)
+	}
+
 	return nil
 }
 
 // execute runs a method of a registered value
-func (s *Server) execute(pCtx context.Context, typ string, name string, data []byte, c codec.Codec) (a any, ctx *Context, err error) {
+func (s *Server) execute(ctx *Context, typ string, name string, data []byte) (a any, err error) {
 	// Try to get value from receivers map
 	val, ok := s.rcvrs[typ]
 	if !ok {
-		return nil, nil, ErrNoSuchReceiver
+		return nil, ErrNoSuchReceiver
 	}
 
 	// Try to retrieve given method
 	mtd := val.MethodByName(name)
 	if !mtd.IsValid() {
-		return nil, nil, ErrNoSuchMethod
+		return nil, ErrNoSuchMethod
 	}
 
 	// If method invalid, return error
 	if !mtdValid(mtd) {
-		return nil, nil, ErrInvalidMethod
+		return nil, ErrInvalidMethod
+	}
+
+	// Make sure the client is allowed to call the method
+	err = s.authorize(ctx, typ, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the method's rate limit hasn't been reached
+	if !s.allowMethod(typ, name) {
+		return nil, ErrResourceExhausted
+	}
+
+	// Don't decode arguments that are too large
+	if s.maxArgSize > 0 && len(data) > s.maxArgSize {
+		ctx.conn.oversized()
+		return nil, ErrMessageTooLarge
 	}
 
 	// Get method type
@@ -122,117 +299,124 @@ func (s *Server) execute(pCtx context.Context, typ string, name string, data []b
 
 	//TODO: if arg not nil but fn has no arg, err
 
-	argType := mtdType.In(1)
-	argVal := reflect.New(argType)
-	arg := argVal.Interface()
-
-	err = c.Unmarshal(data, arg)
-	if err != nil {
-		return nil, nil, err
-	}
+	var arg any
+	if ctx.reqType == types.RequestTypeChannel {
+		// If the client sent a channel, the method must accept one
+		if mtdType.NumIn() != 2 || mtdType.In(1).Kind() != reflect.Chan {
+			return nil, ErrUnexpectedChannel
+		}
 
-	arg = argVal.Elem().Interface()
+		// Create channel that receives the client's values
+		arg = makeArgChannel(ctx, ctx.in, mtdType.In(1)).Interface()
+	} else if mtdType.NumIn() == 2 {
+		// If the method accepts an argument, decode it
+		argType := mtdType.In(1)
+		if argType.Kind() == reflect.Chan {
+			return nil, ErrArgNotChannel
+		}
 
-	ctx = newContext(pCtx, c)
-	// Get reflect value of context
-	ctxVal := reflect.ValueOf(ctx)
+		argVal := reflect.New(argType)
 
-	switch mtdType.NumOut() {
-	case 0: // If method has no return values
-		if mtdType.NumIn() == 2 {
-			if arg == nil {
-				return nil, nil, ErrArgNotProvided
-			}
-			// Call method with arg, ignore returned value
-			mtd.Call([]reflect.Value{ctxVal, reflect.ValueOf(arg)})
-		} else {
-			// Call method without arg, ignore returned value
-			mtd.Call([]reflect.Value{ctxVal})
+		err = ctx.codec.Unmarshal(data, argVal.Interface())
+		if err != nil {
+			return nil, err
 		}
-	case 1: // If method has one return value
-		if mtdType.NumIn() == 2 {
-			if arg == nil {
-				return nil, nil, ErrArgNotProvided
-			}
 
-			// Call method with arg, get returned values
-			out := mtd.Call([]reflect.Value{ctxVal, reflect.ValueOf(arg)})
-
-			// If the first return value's type is error
-			if mtdType.Out(0).Name() == "error" {
-				// Get first return value as interface
-				out0 := out[0].Interface()
-				if out0 == nil {
-					a, err = nil, nil
-				} else {
-					a, err = nil, out0.(error)
-				}
-			} else {
-				a, err = out[0].Interface(), nil
-			}
-		} else {
-			// Call method without arg, get returned values
-			out := mtd.Call([]reflect.Value{ctxVal})
-
-			// If the first return value's type is error
-			if mtdType.Out(0).Name() == "error" {
-				// Get first return value as interface
-				out0 := out[0].Interface()
-				if out0 == nil {
-					a, err = nil, nil
-				} else {
-					a, err = nil, out0.(error)
-				}
-			} else {
-				a, err = out[0].Interface(), nil
-			}
-		}
-	case 2: // If method has two return values
-		if mtdType.NumIn() == 2 {
-			if arg == nil {
-				return nil, nil, ErrArgNotProvided
-			}
+		arg = argVal.Elem().Interface()
+	}
 
-			// Call method with arg and get returned values
-			out := mtd.Call([]reflect.Value{ctxVal, reflect.ValueOf(arg)})
+	// Wait for a worker to run the method
+	release, err := s.acquireWorker(ctx, typ, name)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
-			// Get second return value as interface
-			out1 := out[1].Interface()
-			if out1 != nil {
-				err, ok = out1.(error)
+	// Create handler that calls the method
+	var handler Handler = func(ctx *Context, arg any) (any, error) {
+		return callMethod(mtd, ctx, arg)
+	}
 
-				// If second return value is not an error, the function is invalid
-				if !ok {
-					a, err = nil, ErrInvalidMethod
-				}
-			}
+	// Wrap the handler in the interceptors in reverse order,
+	// so that the first interceptor is the outermost one
+	for i := len(s.interceptors) - 1; i >= 0; i-- {
+		handler = intercept(s.interceptors[i], typ, name, handler)
+	}
 
-			a = out[0].Interface()
-		} else {
-			// Call method without arg and get returned values
-			out := mtd.Call([]reflect.Value{ctxVal})
+	return handler(ctx, arg)
+}
 
-			// Get second return value as interface
-			out1 := out[1].Interface()
-			if out1 != nil {
+// intercept returns a handler that runs the given interceptor
+// with next as the next handler in the chain
+func intercept(i Interceptor, rcvr, method string, next Handler) Handler {
+	return func(ctx *Context, arg any) (any, error) {
+		return i(ctx, rcvr, method, arg, next)
+	}
+}
 
-				// If second return value is not an error, the function is invalid
-				err, ok = out1.(error)
-				if !ok {
-					a, err = nil, ErrInvalidMethod
-				}
-			}
+// callMethod calls the given method with the context and argument,
+// and returns its return value and error
+func callMethod(mtd reflect.Value, ctx *Context, arg any) (any, error) {
+	// Get method type
+	mtdType := mtd.Type()
 
-			a = out[0].Interface()
+	// Create argument slice, starting with the context
+	args := []reflect.Value{reflect.ValueOf(ctx)}
+	if mtdType.NumIn() == 2 {
+		if arg == nil {
+			return nil, ErrArgNotProvided
 		}
+		args = append(args, reflect.ValueOf(arg))
 	}
 
-	return a, ctx, err
+	// Call method and get returned values
+	out := mtd.Call(args)
+
+	switch len(out) {
+	case 1: // If method has one return value
+		// If the first return value's type is error
+		if mtdType.Out(0).Name() == "error" {
+			// Get first return value as interface
+			out0 := out[0].Interface()
+			if out0 == nil {
+				return nil, nil
+			}
+			return nil, out0.(error)
+		}
+		return out[0].Interface(), nil
+	case 2: // If method has two return values
+		// Get second return value as interface
+		out1 := out[1].Interface()
+		if out1 != nil {
+			// If second return value is not an error, the function is invalid
+			err, ok := out1.(error)
+			if !ok {
+				return nil, ErrInvalidMethod
+			}
+			return out[0].Interface(), err
+		}
+		return out[0].Interface(), nil
+	}
+
+	// Method has no return values
+	return nil, nil
 }
 
 // Serve starts the server using the provided listener
 // and codec function
 func (s *Server) Serve(ctx context.Context, ln net.Listener, cf codec.CodecFunc) {
+	// If the server has a TLS config, serve TLS connections
+	if s.tlsConfig != nil {
+		ln = tls.NewListener(ln, s.tlsConfig)
+	}
+
+	// If the server is shutting down, don't accept any connections
+	if !s.trackListener(ln, true) {
+		ln.Close()
+		return
+	}
+	defer s.trackListener(ln, false)
+
 	go func() {
 		<-ctx.Done()
 		ln.Close()
@@ -246,10 +430,8 @@ func (s *Server) Serve(ctx context.Context, ln net.Listener, cf codec.CodecFunc)
 			continue
 		}
 
-		// Create new instance of codec bound to conn
-		c := cf(conn)
 		// Handle connection
-		go s.handleConn(ctx, c)
+		go s.handleConn(ctx, newConn(conn, TransportListener, conn.RemoteAddr()), cf)
 	}
 }
 
@@ -266,7 +448,14 @@ func (s *Server) ServeWS(ctx context.Context, addr string, cf codec.CodecFunc) (
 
 	// Set server handler
 	ws.Handler = func(c *websocket.Conn) {
-		s.handleConn(c.Request().Context(), cf(c))
+		// The WebSocket connection's remote address is the origin
+		// of the request, so use the address of the HTTP client
+		var addr net.Addr
+		addr, _ = net.ResolveTCPAddr("tcp", c.Request().RemoteAddr)
+
+		cn := newConn(c, TransportWebSocket, addr)
+		cn.tlsState = c.Request().TLS
+		s.handleConn(c.Request().Context(), cn, cf)
 	}
 
 	server := &http.Server{
@@ -274,10 +463,21 @@ func (s *Server) ServeWS(ctx context.Context, addr string, cf codec.CodecFunc) (
 		BaseContext: func(net.Listener) context.Context {
 			return ctx
 		},
-		Handler: http.HandlerFunc(ws.ServeHTTP),
+		Handler:   http.HandlerFunc(ws.ServeHTTP),
+		TLSConfig: s.tlsConfig,
+	}
+
+	// If the server is shutting down, don't start the HTTP server
+	if !s.trackHTTPServer(server, true) {
+		return http.ErrServerClosed
 	}
+	defer s.trackHTTPServer(server, false)
 
-	// Listen and serve on given address
+	// Listen and serve on given address, using TLS
+	// if the server has a TLS config
+	if s.tlsConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
 	return server.ListenAndServe()
 }
 
@@ -285,39 +485,300 @@ func (s *Server) ServeWS(ctx context.Context, addr string, cf codec.CodecFunc) (
 // This may be useful if something other than a net.Listener
 // needs to be used
 func (s *Server) ServeConn(ctx context.Context, conn io.ReadWriter, cf codec.CodecFunc) {
-	s.handleConn(ctx, cf(conn))
+	s.handleConn(ctx, newConn(conn, TransportConn, remoteAddr(conn)), cf)
+}
+
+// OnConnect adds a hook that's called when a client connects,
+// before any of its calls are handled
+func (s *Server) OnConnect(hook ConnHook) {
+	s.onConnect = append(s.onConnect, hook)
 }
 
-// handleConn handles a connection
-func (s *Server) handleConn(pCtx context.Context, c codec.Codec) {
-	codecMtx := &sync.Mutex{}
+// OnDisconnect adds a hook that's called
+// when a client's connection ends
+func (s *Server) OnDisconnect(hook ConnHook) {
+	s.onDisconnect = append(s.onDisconnect, hook)
+}
+
+// handleConn handles a connection. Clients that don't perform
+// the handshake are served using cf.
+func (s *Server) handleConn(pCtx context.Context, cn *Conn, cf codec.CodecFunc) {
+
+	// If the server is shutting down, close the connection
+	// instead of serving it
+	if !s.trackConn(cn, true) {
+		cn.close()
+		return
+	}
+	defer s.trackConn(cn, false)
+	defer cn.close()
+
+	// Cancel the contexts of all calls once the connection ends
+	pCtx, cancel := context.WithCancel(pCtx)
+	defer cancel()
+
+	// Close connections that stay idle,
+	// even during authentication
+	if s.idleTimeout > 0 {
+		go s.closeIdle(cn)
+	}
+
+	// Disconnect clients that aren't authenticated in time
+	var authTimer *time.Timer
+	if s.authenticator != nil && s.authTimeout > 0 {
+		authTimer = time.AfterFunc(s.authTimeout, cn.close)
+	}
+
+	// Complete the TLS handshake, if there is one,
+	// so that the client's certificate is available
+	err := cn.handshake(pCtx)
+	if err != nil {
+		return
+	}
+
+	// Agree on a codec with the client
+	err = s.negotiate(cn, cf)
+	if err != nil {
+		return
+	}
+	c := cn.codec
+
+	// Authenticate the client before handling any of its calls
+	if s.authenticator != nil {
+		err = s.authenticate(cn)
+		if authTimer != nil {
+			authTimer.Stop()
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	// Unauthenticated clients are rate limited per connection
+	if s.clientLimits != nil && cn.identity == nil {
+		cn.bucket = s.clientLimits.Bucket()
+	}
+
+	// Detect dead connections
+	if s.keepaliveInterval > 0 {
+		go s.keepalive(cn)
+	}
+
+	// Create map for the contexts of the connection's calls
+	ctxs := s.newContextMap()
+	defer s.deleteContextMap(ctxs)
+
+	for _, hook := range s.onConnect {
+		hook(cn)
+	}
+	defer func() {
+		for _, hook := range s.onDisconnect {
+			hook(cn)
+		}
+	}()
+
+	// Create map for channels sent by the client
+	inChs := &inChannels{chs: map[string]*inChannel{}}
 
 	for {
 		var call types.Request
 		// Read request using codec
 		err := c.Decode(&call)
-		if err == io.EOF {
+		if errors.Is(err, codec.ErrMalformed) {
+			// The codec skipped the message, so the connection can
+			// still be used. Clients that keep sending messages that
+			// are too large are disconnected.
+			if errors.Is(err, codec.ErrMessageTooLarge) {
+				cn.oversized()
+			}
+			// If the ID could be decoded before the rest of the
+			// message failed, the error is for that call. Otherwise,
+			// it's sent without an ID, and the client fails every
+			// call waiting for a response, since it can't tell
+			// which one the message belonged to.
+			s.sendErr(c, nil, types.Request{ID: call.ID}, nil, err)
+			s.closeIfOversized(cn)
+			continue
+		} else if errors.Is(err, codec.ErrMessageTooLarge) {
+			// The rest of the message can't be skipped,
+			// so tell the client why and close the connection
+			s.sendErr(c, nil, types.Request{}, nil, err)
 			break
 		} else if err != nil {
-			s.sendErr(c, call, nil, err)
+			// Most codecs read directly from the connection, so
+			// they can't recover from errors, and the connection
+			// can't be used anymore. This also happens when the
+			// connection was closed or reset.
+			break
+		}
+
+		cn.activity.Touch()
+
+		switch call.Type {
+		case types.RequestTypePing:
+			// The client wants to know if the server is still there.
+			// The pong is sent in a separate goroutine, so that
+			// requests keep being read even if sending blocks.
+			go c.Encode(types.Response{Type: types.ResponseTypePong})
 			continue
+		case types.RequestTypePong:
+			// The client responded to a ping
+			continue
+		}
+
+		// Keepalive pings don't keep the connection from being idle,
+		// but anything else does
+		cn.touch()
+
+		switch call.Type {
+		case types.RequestTypeChannelValue:
+			// Send value to the channel it belongs to. If there's no
+			// room for it, the client sent more values than its window
+			// allows, and values would be lost, so tell the client why
+			// and close the connection.
+			err = inChs.send(call.ID, call.Arg)
+			if err != nil {
+				s.sendErr(c, nil, types.Request{}, nil, err)
+				return
+			}
+			continue
+		case types.RequestTypeChannelDone:
+			// The client closed its channel, so close ours
+			inChs.close(call.ID)
+			continue
+		case types.RequestTypeCredit:
+			// The client has consumed values from a channel,
+			// so allow more values to be sent
+			s.addCredits(ctxs, call.ID, call.Window)
+			continue
+		case types.RequestTypeBatch:
+			// Execute every call in the batch and
+			// send back all the results at once
+			err = s.admit(cn, call)
+			if err != nil {
+				s.sendErr(c, nil, call, nil, err)
+				continue
+			}
+			if !s.startCall(cn) {
+				s.releaseCall(cn, call)
+				s.sendErr(c, nil, call, nil, ErrShuttingDown)
+				continue
+			}
+
+			// Create context for the whole batch, which is the parent
+			// of the contexts of its calls, so that the client can
+			// cancel all of them. It's stored before handling any more
+			// requests, so that the cancellation can't be lost.
+			bCtx := newContext(pCtx, cn, call.Timeout, call.Meta)
+			bCtx.contexts = ctxs
+			ctxs.store(call.ID, bCtx)
+
+			go s.handleBatch(bCtx, cn, call)
+			continue
+		}
+
+		// Calls that close channels or cancel other calls are
+		// always allowed, as they help in-progress calls finish.
+		// All other calls are rejected once the server is
+		// shutting down.
+		tracked := !isControlCall(call.Receiver, call.Method)
+		if tracked {
+			// Reject calls over the connection's limits
+			err = s.admit(cn, call)
+			if err != nil {
+				if !call.Notify {
+					s.sendErr(c, nil, call, nil, err)
+				}
+				continue
+			}
+
+			if !s.startCall(cn) {
+				s.releaseCall(cn, call)
+				if !call.Notify {
+					s.sendErr(c, nil, call, nil, ErrShuttingDown)
+				}
+				continue
+			}
+		}
+
+		// Create context for the call
+		ctx := newContext(pCtx, cn, call.Timeout, call.Meta)
+		ctx.contexts = ctxs
+
+		ctx.reqType = call.Type
+		ctx.notify = call.Notify
+		ctx.window = s.channelWindow
+		ctx.clientWindow = call.Window
+
+		// If the client will send values on a channel or stream, create
+		// the channel that will receive them before handling any more
+		// requests, so that no values are lost.
+		if call.Type == types.RequestTypeChannel || call.Type == types.RequestTypeStream {
+			ctx.in = inChs.add(ctx, call.ID, s.channelWindow)
 		}
 
+		// Store context in map while the call is in progress, so
+		// that the client can cancel it. This is done before handling
+		// any more requests, so that a cancellation sent right after
+		// the call can't be handled before the context is stored.
+		ctxs.store(call.ID, ctx)
+
 		go func() {
+			if tracked {
+				defer s.endCall(cn)
+			}
+			defer s.closeIfOversized(cn)
+
+			// If the call panics, recover and send an error
+			// instead of crashing the server
+			defer func() {
+				if v := recover(); v != nil {
+					s.handlePanic(ctx, c, call, v)
+				}
+			}()
+
+			// The call stops counting towards the connection's
+			// limit as soon as it's executed, before the response
+			// is sent, so that the client can make another one
+			// once it gets the response
+			released := !tracked
+			release := func() {
+				if !released {
+					released = true
+					s.releaseCall(cn, call)
+				}
+			}
+			defer release()
+
 			// Execute decoded call
-			val, ctx, err := s.execute(
-				pCtx,
+			val, err := s.execute(
+				ctx,
 				call.Receiver,
 				call.Method,
 				call.Arg,
-				c,
 			)
+			release()
+
+			// The call is over, so remove its context from the map
+			ctxs.delete(call.ID)
+
+			// If the method didn't create a channel or returned an
+			// error, release the context's resources once done
+			if !ctx.isChannel || err != nil {
+				defer ctx.cancel()
+			}
+
+			// The client doesn't want a response to notifications
+			if call.Notify {
+				return
+			}
+
 			if err != nil {
-				s.sendErr(c, call, val, err)
+				s.sendErr(c, ctx, call, val, err)
 			} else {
 				valData, err := c.Marshal(val)
 				if err != nil {
-					s.sendErr(c, call, val, err)
+					s.sendErr(c, ctx, call, val, err)
 					return
 				}
 
@@ -325,13 +786,14 @@ func (s *Server) handleConn(pCtx context.Context, c codec.Codec) {
 				res := types.Response{
 					ID:     call.ID,
 					Return: valData,
+					Meta:   ctx.outgoingMetadata(),
 				}
 
 				// If function has created a channel
 				if ctx.isChannel {
 					idData, err := c.Marshal(ctx.channelID)
 					if err != nil {
-						s.sendErr(c, call, val, err)
+						s.sendErr(c, ctx, call, val, err)
 						return
 					}
 
@@ -341,66 +803,205 @@ func (s *Server) handleConn(pCtx context.Context, c codec.Codec) {
 					res.Return = idData
 
 					// Store context in map for future use
-					s.contextsMtx.Lock()
-					s.contexts[ctx.channelID] = ctx
-					s.contextsMtx.Unlock()
-
-					go func() {
-						// For every value received from channel
-						for val := range ctx.channel {
-							codecMtx.Lock()
-
-							valData, err := c.Marshal(val)
-							if err != nil {
-								continue
-							}
-
-							// Encode response using codec
-							c.Encode(types.Response{
-								ID:     ctx.channelID,
-								Return: valData,
-							})
-
-							codecMtx.Unlock()
-						}
-
-						// Cancel context
-						ctx.cancel()
-						// Delete context from map
-						s.contextsMtx.Lock()
-						delete(s.contexts, ctx.channelID)
-						s.contextsMtx.Unlock()
-
-						codecMtx.Lock()
-						c.Encode(types.Response{
-							Type: types.ResponseTypeChannelDone,
-							ID:   ctx.channelID,
-						})
-						codecMtx.Unlock()
-					}()
+					ctxs.store(ctx.channelID, ctx)
 				}
 
 				// Encode response using codec
-				codecMtx.Lock()
 				c.Encode(res)
-				codecMtx.Unlock()
-			}
 
+				// If function has created a channel, start sending its
+				// values. This must happen after the response is sent,
+				// as the client needs the channel ID before any values.
+				if ctx.isChannel {
+					s.calls.Add(1)
+					cn.begin()
+					go s.forwardChannel(ctx, cn)
+				}
+			}
 		}()
 	}
 }
 
-// sendErr sends an error response
-func (s *Server) sendErr(c codec.Codec, req types.Request, val any, err error) {
-	valData, _ := c.Marshal(val)
+// handlePanic handles a value recovered from a panic
+// in the given call
+func (s *Server) handlePanic(ctx *Context, c codec.Codec, call types.Request, v any) {
+	pErr := s.panicError(ctx, call, v)
 
-	// Encode error response using codec
+	// The call is over, so cancel its context
+	// and remove it from the map
+	ctx.cancel()
+	ctx.contexts.delete(call.ID)
+
+	// The client doesn't want a response to notifications
+	if call.Notify {
+		return
+	}
+
+	s.sendErr(c, ctx, call, nil, pErr)
+}
+
+// panicError reports a value recovered from a panic in the given
+// call to the panic handler, and returns the error that should be
+// sent to the client
+func (s *Server) panicError(ctx *Context, call types.Request, v any) *PanicError {
+	pErr := &PanicError{Value: v, Stack: debug.Stack()}
+
+	// Report panic to the panic handler if one is set
+	if s.panicHandler != nil {
+		s.panicHandler(ctx, call.Receiver, call.Method, pErr)
+	}
+
+	// Only send the stack trace to the client in debug mode
+	if !s.debug {
+		pErr = &PanicError{Value: v}
+	}
+
+	return pErr
+}
+
+// addCredits adds credits to the window of the channel
+// with the given ID in the given context map
+func (s *Server) addCredits(ctxs *contextMap, chID string, n int) {
+	ctx, ok := ctxs.get(chID)
+
+	if ok && ctx.sendWindow != nil {
+		ctx.sendWindow.Add(n)
+	}
+}
+
+// forwardChannel sends every value received from the channel created
+// by ctx to the client, until the channel is closed. If the client
+// uses flow control, it waits for credits from the client before
+// sending each value, so that a slow client only stalls this channel.
+func (s *Server) forwardChannel(ctx *Context, cn *Conn) {
+	defer s.endCall(cn)
+	c := cn.codec
+
+	// For every value received from channel
+	for val := range ctx.channel {
+		// Wait until the client is ready for another value
+		if ctx.sendWindow != nil && !ctx.sendWindow.Take(ctx.Done()) {
+			break
+		}
+
+		valData, err := c.Marshal(val)
+		if err != nil {
+			continue
+		}
+
+		// Encode response using codec
+		c.Encode(types.Response{
+			ID:     ctx.channelID,
+			Return: valData,
+		})
+	}
+
+	// If this is a stream, the client may still be sending values,
+	// so tell the client that no more values will be sent and wait
+	// for it to close its side of the stream as well
+	if ctx.reqType == types.RequestTypeStream {
+		s.sendChannelDone(ctx, c)
+
+		select {
+		case <-ctx.in.eof:
+		case <-ctx.Done():
+		}
+	}
+
+	// Cancel context
+	ctx.cancel()
+	// Delete context from map
+	ctx.contexts.delete(ctx.channelID)
+
+	if ctx.reqType != types.RequestTypeStream {
+		s.sendChannelDone(ctx, c)
+	}
+}
+
+// sendChannelDone tells the client that the channel
+// created by ctx is done
+func (s *Server) sendChannelDone(ctx *Context, c codec.Codec) {
 	c.Encode(types.Response{
+		Type: types.ResponseTypeChannelDone,
+		ID:   ctx.channelID,
+	})
+}
+
+// sendErr sends an error response. If ctx is not nil,
+// its outgoing metadata is sent along with the error.
+func (s *Server) sendErr(c codec.Codec, ctx *Context, req types.Request, val any, err error) {
+	// Encode error response using codec
+	c.Encode(s.errResponse(c, ctx, req, val, err))
+}
+
+// errResponse creates an error response. If ctx is not nil,
+// its outgoing metadata is sent along with the error.
+func (s *Server) errResponse(c codec.Codec, ctx *Context, req types.Request, val any, err error) types.Response {
+	valData, _ := c.Marshal(val)
+
+	// Create error response
+	res := types.Response{
 		Type:   types.ResponseTypeError,
 		ID:     req.ID,
-		Error:  err.Error(),
+		Error:  encodeErr(c, err),
 		Return: valData,
-	})
+	}
+
+	if ctx != nil {
+		res.Meta = ctx.outgoingMetadata()
+	}
+
+	return res
+}
+
+// encodeErr converts err into an error that can be sent to the client,
+// preserving its code and details
+func encodeErr(c codec.Codec, err error) *types.Error {
+	e := errs.From(err)
+	out := &types.Error{
+		Code:    string(e.Code),
+		Message: e.Message,
+	}
+
+	if e.Details != nil {
+		out.Details, _ = c.Marshal(e.Details)
+	}
+
+	return out
+}
+
+// isControlCall returns true if the given method is one of
+// the built-in functions that close channels or cancel calls
+func isControlCall(rcvr, method string) bool {
+	return rcvr == "lrpc" &&
+		(method == "ChannelDone" || method == "CancelCall")
+}
+
+// syncCodec wraps a codec, making sure only
+// one message is encoded at a time
+type syncCodec struct {
+	codec.Codec
+	mtx sync.Mutex
+}
+
+func (sc *syncCodec) Encode(val any) error {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+
+	// Nothing can be sent until the
+	// codec has been chosen
+	if sc.Codec == nil {
+		return errNoCodec
+	}
+
+	return sc.Codec.Encode(val)
+}
+
+// setCodec sets the codec that's wrapped
+func (sc *syncCodec) setCodec(c codec.Codec) {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	sc.Codec = c
 }
 
 // lrpc contains functions registered on every server
@@ -409,19 +1010,13 @@ type lrpc struct {
 }
 
 // ChannelDone cancels a context and closes the associated channel
-func (l lrpc) ChannelDone(_ *Context, id string) {
-	// Try to get context
-	ctx, ok := l.srv.contexts[id]
-	if !ok {
-		return
-	}
+func (l lrpc) ChannelDone(ctx *Context, id string) {
+	ctx.contexts.cancel(id)
+}
 
-	// Cancel context
-	ctx.cancel()
-	// Delete context from map
-	l.srv.contextsMtx.Lock()
-	delete(l.srv.contexts, id)
-	l.srv.contextsMtx.Unlock()
+// CancelCall cancels the context of an in-progress call
+func (l lrpc) CancelCall(ctx *Context, id string) {
+	ctx.contexts.cancel(id)
 }
 
 // MethodDesc describes methods on a receiver
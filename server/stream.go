@@ -0,0 +1,122 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrStreamClosed is returned when sending on a stream
+// whose sending side has been closed
+var ErrStreamClosed = errors.New("stream is closed")
+
+// Stream is the server's side of a bidirectional stream
+// created using Context.MakeStream
+type Stream struct {
+	ctx *Context
+
+	sendMtx    sync.RWMutex
+	sendClosed bool
+}
+
+func newStream(ctx *Context) *Stream {
+	st := &Stream{ctx: ctx}
+
+	// Close the sending side once the context is done,
+	// so that the stream's resources are released
+	go func() {
+		<-ctx.Done()
+		st.CloseSend()
+	}()
+
+	return st
+}
+
+// Context returns the context of the call that created the stream
+func (st *Stream) Context() *Context {
+	return st.ctx
+}
+
+// Send sends a value to the client. It blocks until the value
+// is queued or the stream's context is done.
+func (st *Stream) Send(v any) error {
+	st.sendMtx.RLock()
+	defer st.sendMtx.RUnlock()
+
+	if st.sendClosed {
+		return ErrStreamClosed
+	}
+
+	select {
+	case st.ctx.channel <- v:
+		return nil
+	case <-st.ctx.Done():
+		return st.ctx.Err()
+	}
+}
+
+// Recv receives a value sent by the client and decodes it into v,
+// which must be a pointer. It returns io.EOF once the client has
+// closed its sending side of the stream.
+func (st *Stream) Recv(v any) error {
+	in := st.ctx.in
+
+	// Prefer values that have already been received
+	// over the context being done
+	select {
+	case data, ok := <-in.ch:
+		return st.decode(data, ok, v)
+	default:
+	}
+
+	select {
+	case data, ok := <-in.ch:
+		return st.decode(data, ok, v)
+	case <-in.done:
+		return st.ctx.Err()
+	}
+}
+
+// decode decodes data received from the client into v
+func (st *Stream) decode(data []byte, ok bool, v any) error {
+	if !ok {
+		return io.EOF
+	}
+
+	// Allow the client to send another value
+	st.ctx.in.granter.Consumed()
+	return st.ctx.codec.Unmarshal(data, v)
+}
+
+// CloseSend closes the sending side of the stream. The client
+// will receive io.EOF once it has received all sent values.
+// The stream ends once both sides are closed.
+func (st *Stream) CloseSend() {
+	st.sendMtx.Lock()
+	defer st.sendMtx.Unlock()
+
+	if st.sendClosed {
+		return
+	}
+
+	st.sendClosed = true
+	close(st.ctx.channel)
+}
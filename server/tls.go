@@ -0,0 +1,67 @@
+/*
+ *	lrpc allows for clients to call functions on a server remotely.
+ *	Copyright (C) 2022 Arsen Musayelyan
+ *
+ *	This program is free software: you can redistribute it and/or modify
+ *	it under the terms of the GNU General Public License as published by
+ *	the Free Software Foundation, either version 3 of the License, or
+ *	(at your option) any later version.
+ *
+ *	This program is distributed in the hope that it will be useful,
+ *	but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *	GNU General Public License for more details.
+ *
+ *	You should have received a copy of the GNU General Public License
+ *	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// TLSState returns the state of the connection's TLS session,
+// or nil if the connection doesn't use TLS
+func (cn *Conn) TLSState() *tls.ConnectionState {
+	return cn.tlsState
+}
+
+// PeerCertificate returns the client's certificate if it was
+// verified by the server using mutual TLS, or nil otherwise
+func (cn *Conn) PeerCertificate() *x509.Certificate {
+	// Only return certificates that were verified, since
+	// the client can send any certificate otherwise
+	if cn.tlsState == nil || len(cn.tlsState.VerifiedChains) == 0 {
+		return nil
+	}
+	return cn.tlsState.VerifiedChains[0][0]
+}
+
+// PeerCertificate returns the certificate of the client that made
+// the call if it was verified using mutual TLS, or nil otherwise.
+// Its subject can be used to authorize the client.
+func (ctx *Context) PeerCertificate() *x509.Certificate {
+	return ctx.conn.PeerCertificate()
+}
+
+// handshake completes the TLS handshake if cn is a TLS connection,
+// so that its state is available before any calls are handled
+func (cn *Conn) handshake(ctx context.Context) error {
+	tc, ok := cn.rw.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	err := tc.HandshakeContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	state := tc.ConnectionState()
+	cn.tlsState = &state
+	return nil
+}